@@ -0,0 +1,96 @@
+package main
+
+/*
+ * admin.go
+ * Administrative requests
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/* ADMINSOCKADDR is the address used for logging requests made via the admin
+socket */
+const ADMINSOCKADDR = "<Admin Socket>"
+
+/* ADMINMUX routes privileged requests, which are served on the admin socket
+and, to authenticated administrators, over HTTP under ADMINHTTPPATH */
+var ADMINMUX = http.NewServeMux()
+
+/* ADMINVIEWPATH is the path, after URLPATH, under which administrators see
+the public pages which show results, without the limits set by -visibility */
+const ADMINVIEWPATH = "/admin"
+
+/* adminSock serves ADMINMUX on a unix socket at path, which is only
+accessible to the user running cgiscan */
+func adminSock(path string) {
+	l, err := listenUnix(path, 0600)
+	if nil != err {
+		log.Fatalf("ERROR: Unable to listen on %v: %v", path, err)
+	}
+	log.Printf("Listening for admin requests on %v", l.Addr())
+	listenerUp("admin", l)
+	if err := http.Serve(l, http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(
+				req.Context(),
+				adminKey{},
+				ADMINSOCKADDR,
+			)
+			ADMINMUX.ServeHTTP(w, req.WithContext(ctx))
+		},
+	)); nil != err {
+		log.Fatalf(
+			"ERROR: Unable to serve admin requests on %v: %v",
+			l.Addr(),
+			err,
+		)
+	}
+}
+
+/* adminView serves an administrator's request for one of the public pages
+which show results with h, which sees the page's usual path.  Requests via the
+admin socket have no port, so are given ADMINSOCKADDR as their address. */
+func adminView(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r := req.Clone(req.Context())
+		r.URL.Path = URLPATH + strings.TrimPrefix(
+			req.URL.Path,
+			ADMINVIEWPATH,
+		)
+		if _, _, err := net.SplitHostPort(r.RemoteAddr); nil != err {
+			r.RemoteAddr = net.JoinHostPort(ADMINSOCKADDR, "0")
+		}
+		h(w, r)
+	}
+}
+
+/* viewPath returns the path, after URLPATH, under which pages which show
+results are served to the maker of req */
+func viewPath(req *http.Request) string {
+	if isAdmin(req) {
+		return ADMINVIEWPATH
+	}
+	return ""
+}
+
+/* adminClient returns an HTTP client which makes its requests via the admin
+socket at path.  The host part of URLs requested with it is ignored. */
+func adminClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(
+			ctx context.Context,
+			_, _ string,
+		) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
@@ -0,0 +1,236 @@
+package main
+
+/*
+ * annotate.go
+ * Labels, owners, and notes for addresses
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/* ANNOTBUCKET holds an annotation for each annotated address */
+const ANNOTBUCKET = "Annotations"
+
+/* annotation describes an address */
+type annotation struct {
+	Labels  []string  `json:"labels,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+	Notes   string    `json:"notes,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+/* empty returns true if an has nothing worth saving */
+func (an *annotation) empty() bool {
+	return 0 == len(an.Labels) && "" == an.Owner && "" == an.Notes
+}
+
+/* hasLabel returns true if an has label l, ignoring case */
+func (an *annotation) hasLabel(l string) bool {
+	for _, al := range an.Labels {
+		if strings.EqualFold(al, l) {
+			return true
+		}
+	}
+	return false
+}
+
+/* parseLabels splits a comma-separated list of labels */
+func parseLabels(s string) []string {
+	var ls []string
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); "" != l {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+/* getAnnotation gets a's annotation, or nil if it has none */
+func getAnnotation(a string) (*annotation, error) {
+	v, err := STORE.GetKV(ANNOTBUCKET, a)
+	if nil != err || nil == v {
+		return nil, err
+	}
+	an := &annotation{}
+	if err := json.Unmarshal(v, an); nil != err {
+		return nil, fmt.Errorf("decoding annotation for %v: %v", a, err)
+	}
+	return an, nil
+}
+
+/* putAnnotation saves an as a's annotation, or removes a's annotation if an
+is empty */
+func putAnnotation(a string, an *annotation) error {
+	if an.empty() {
+		return STORE.DeleteKV(ANNOTBUCKET, a)
+	}
+	an.Updated = time.Now()
+	v, err := json.Marshal(an)
+	if nil != err {
+		return err
+	}
+	return STORE.PutKV(ANNOTBUCKET, a, v)
+}
+
+/* allAnnotations returns every address' annotation */
+func allAnnotations() (map[string]*annotation, error) {
+	ans := make(map[string]*annotation)
+	err := STORE.ForEachKV(ANNOTBUCKET, func(k string, v []byte) error {
+		an := &annotation{}
+		if err := json.Unmarshal(v, an); nil != err {
+			return fmt.Errorf(
+				"decoding annotation for %v: %v",
+				k,
+				err,
+			)
+		}
+		ans[k] = an
+		return nil
+	})
+	return ans, err
+}
+
+/* adminAnnotate sends back the annotation for the address in the address
+query parameter as JSON.  If the request is a POST, the annotation is first
+replaced with the labels (comma-separated), owner, and notes form values. */
+func adminAnnotate(w http.ResponseWriter, req *http.Request) {
+	/* Work out the address */
+	ip := net.ParseIP(req.FormValue("address"))
+	if nil == ip {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Invalid or missing address.")
+		return
+	}
+	a := ip.String()
+
+	/* Update the annotation, if we're meant to */
+	if http.MethodPost == req.Method {
+		an := &annotation{
+			Labels: parseLabels(req.PostFormValue("labels")),
+			Owner:  strings.TrimSpace(req.PostFormValue("owner")),
+			Notes:  strings.TrimSpace(req.PostFormValue("notes")),
+		}
+		if err := putAnnotation(a, an); nil != err {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			log.Printf(
+				"%v Error annotating %v: %v",
+				adminWho(req),
+				a,
+				err,
+			)
+			return
+		}
+		log.Printf(
+			"%v Annotated %v: labels %q, owner %q, notes %q",
+			adminWho(req),
+			a,
+			an.Labels,
+			an.Owner,
+			an.Notes,
+		)
+	}
+
+	/* Send it back */
+	an, err := getAnnotation(a)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if nil == an {
+		an = &annotation{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(an)
+}
+
+/* annotateCmd implements the annotate subcommand */
+func annotateCmd(args []string) {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	var (
+		adminPath = fs.String(
+			"admin",
+			"",
+			"Admin socket `path` of the running cgiscan",
+		)
+		labels = fs.String(
+			"labels",
+			"",
+			"Comma-separated `list` of labels",
+		)
+		owner = fs.String(
+			"owner",
+			"",
+			"Address' `owner`",
+		)
+		notes = fs.String(
+			"notes",
+			"",
+			"Free-text `notes`",
+		)
+		show = fs.Bool(
+			"show",
+			false,
+			"Show the annotation instead of replacing it",
+		)
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v annotate -admin path [options] address
+
+Replaces the annotation for an address via a running cgiscan's admin socket.
+The annotation is removed if no labels, owner, or notes are given.  The
+updated annotation is printed as JSON.
+
+Options:
+`, os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if "" == *adminPath || 1 != fs.NArg() {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	/* Send the annotation, or ask for it */
+	var (
+		c   = adminClient(*adminPath)
+		q   = url.Values{"address": {fs.Arg(0)}}
+		res *http.Response
+		err error
+	)
+	if *show {
+		res, err = c.Get("http://cgiscan/admin/annotate?" + q.Encode())
+	} else {
+		q.Set("labels", *labels)
+		q.Set("owner", *owner)
+		q.Set("notes", *notes)
+		res, err = c.PostForm("http://cgiscan/admin/annotate", q)
+	}
+	if nil != err {
+		log.Fatalf("Unable to annotate: %v", err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	if http.StatusOK != res.StatusCode {
+		log.Fatalf("Annotation failed (%v): %s", res.Status, b)
+	}
+	os.Stdout.Write(b)
+}
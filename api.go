@@ -0,0 +1,365 @@
+package main
+
+/*
+ * api.go
+ * JSON API
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* APIPATH is the URL path, after URLPATH, under which the API is served */
+const APIPATH = "/api/v1"
+
+/* Scan states, as reported by the API */
+const (
+	STATEIDLE     = "idle"
+	STATEQUEUED   = "queued"
+	STATESCANNING = "scanning"
+)
+
+/* apiError is sent back when something goes wrong */
+type apiError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+/* apiQaddr is a queued or in-progress address */
+type apiQaddr struct {
+	Addr  string    `json:"address"`
+	Since time.Time `json:"since"`
+	Link  bool      `json:"-"` /* Requestor may see Addr's results */
+}
+
+/* apiState is an address' place in the scan queue */
+type apiState struct {
+	Addr     string     `json:"address"`
+	State    string     `json:"state"`
+	Since    *time.Time `json:"since,omitempty"`
+	Position int        `json:"queue_position,omitempty"`
+}
+
+/* apiStatus is the service status for a requestor */
+type apiStatus struct {
+	apiState
+	QueueLength    int         `json:"queue_length"`
+	Uptime         float64     `json:"uptime_seconds"`
+	CompletedScans int         `json:"completed_scans"`
+	AverageScan    float64     `json:"average_scan_seconds"`
+	MedianScan     float64     `json:"median_scan_seconds"`
+	Latest         *result     `json:"latest"`
+	Annotation     *annotation `json:"annotation,omitempty"`
+}
+
+/* apiResult is a result and its address' annotation */
+type apiResult struct {
+	*result
+	Annotation *annotation `json:"annotation,omitempty"`
+}
+
+/* apiWrite sends v as JSON with the given HTTP status */
+func apiWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+/* apiFail sends an apiError with the given HTTP status and message */
+func apiFail(
+	w http.ResponseWriter,
+	status int,
+	format string,
+	a ...interface{},
+) {
+	var e apiError
+	e.Error.Status = status
+	e.Error.Message = fmt.Sprintf(format, a...)
+	apiWrite(w, status, e)
+}
+
+/* apiMethod makes sure req's method is one of ms.  If not, it sends back an
+error and returns false. */
+func apiMethod(w http.ResponseWriter, req *http.Request, ms ...string) bool {
+	for _, m := range ms {
+		if m == req.Method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(ms, ", "))
+	apiFail(
+		w,
+		http.StatusMethodNotAllowed,
+		"method %v not allowed, must be %v",
+		req.Method,
+		strings.Join(ms, " or "),
+	)
+	return false
+}
+
+/* apiRequestor gets the requestor's address.  If it can't, it sends back an
+error and returns false. */
+func apiRequestor(w http.ResponseWriter, req *http.Request) (string, bool) {
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		apiFail(w, http.StatusInternalServerError, "%v", err)
+		return "", false
+	}
+	return rip, true
+}
+
+/* queueState returns a's place in the scan queue, and the length of the
+queue */
+func queueState(a string) (apiState, int) {
+	queued, started, startTime, qpos, qlen := inQueue(a)
+	s := apiState{Addr: a, State: STATEIDLE}
+	switch {
+	case started:
+		s.State = STATESCANNING
+		s.Since = &startTime
+	case queued:
+		s.State = STATEQUEUED
+		s.Since = &startTime
+		s.Position = qpos
+	}
+	return s, qlen
+}
+
+/* apiNotFound handles requests for API endpoints which don't exist */
+func apiNotFound(w http.ResponseWriter, req *http.Request) {
+	apiFail(w, http.StatusNotFound, "no such endpoint %v", req.URL.Path)
+}
+
+/* apiStatusHandler sends the requestor's status */
+func apiStatusHandler(w http.ResponseWriter, req *http.Request) {
+	if !apiMethod(w, req, http.MethodGet) {
+		return
+	}
+	rip, ok := apiRequestor(w, req)
+	if !ok {
+		return
+	}
+
+	s, err := getStatus(rip)
+	if nil != err {
+		apiFail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	apiWrite(w, http.StatusOK, s)
+	debug("%v API status: %v", rip, s.State)
+}
+
+/* getStatus gathers a's status.  The latest result is left out if a may not
+see it. */
+func getStatus(a string) (apiStatus, error) {
+	st, qlen := queueState(a)
+	var (
+		latest *result
+		err    error
+	)
+	if canSee(a, a) {
+		if latest, err = STORE.Get(a); nil != err {
+			return apiStatus{}, err
+		}
+	}
+	an, err := getAnnotation(a)
+	if nil != err {
+		return apiStatus{}, err
+	}
+	ss := totalStats()
+	return apiStatus{
+		apiState:       st,
+		QueueLength:    qlen,
+		Uptime:         time.Since(START).Seconds(),
+		CompletedScans: ss.Scans,
+		AverageScan:    ss.Average.Seconds(),
+		MedianScan:     ss.Median.Seconds(),
+		Latest:         latest,
+		Annotation:     an,
+	}, nil
+}
+
+/* apiScan queues the requestor for scanning */
+func apiScan(w http.ResponseWriter, req *http.Request) {
+	if !apiMethod(w, req, http.MethodPost) {
+		return
+	}
+	if !apiCSRF(w, req) {
+		return
+	}
+	rip, ok := apiRequestor(w, req)
+	if !ok {
+		return
+	}
+	enqueue(rip)
+	st, _ := queueState(rip)
+	apiWrite(w, http.StatusAccepted, st)
+	debug("%v API scan: %v", rip, st.State)
+}
+
+/* apiRes sends the latest result for the address at the end of the URL */
+func apiRes(w http.ResponseWriter, req *http.Request) {
+	if !apiMethod(w, req, http.MethodGet) {
+		return
+	}
+	rip, ok := apiRequestor(w, req)
+	if !ok {
+		return
+	}
+
+	/* Work out the address */
+	ip := net.ParseIP(strings.TrimPrefix(
+		req.URL.Path,
+		URLPATH+APIPATH+"/res/",
+	))
+	if nil == ip {
+		apiFail(
+			w,
+			http.StatusBadRequest,
+			"the URL must end in %v/res/<address>",
+			APIPATH,
+		)
+		return
+	}
+	a := ip.String()
+	if !canSee(rip, a) {
+		apiFail(w, http.StatusForbidden, "%v", hiddenMessage(a))
+		debug("%v API refused result for %v", rip, a)
+		return
+	}
+
+	/* Get its result */
+	r, err := STORE.Get(a)
+	if nil != err {
+		apiFail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if nil == r {
+		apiFail(w, http.StatusNotFound, "no scan results for %v", a)
+		return
+	}
+	an, err := getAnnotation(a)
+	if nil != err {
+		apiFail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	apiWrite(w, http.StatusOK, apiResult{result: r, Annotation: an})
+	debug("%v API result for %v", rip, a)
+}
+
+/* apiList sends the list of scanned addresses the requestor may list,
+optionally only those with the label in the label query parameter.  Hidden
+addresses are sent as the requestor may see them. */
+func apiList(w http.ResponseWriter, req *http.Request) {
+	if !apiMethod(w, req, http.MethodGet) {
+		return
+	}
+	rip, ok := apiRequestor(w, req)
+	if !ok {
+		return
+	}
+
+	/* Annotations, if needed to filter */
+	var ans map[string]*annotation
+	label := req.URL.Query().Get("label")
+	if "" != label {
+		var err error
+		if ans, err = allAnnotations(); nil != err {
+			apiFail(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+	}
+
+	/* Get the addresses, in list order */
+	if err := fillListOrder(); nil != err {
+		apiFail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	as := make([]string, 0)
+	if err := forEachListed(
+		LISTSORTADDR,
+		false,
+		"",
+		LISTMAXPAGE,
+		func(a string) (bool, error) {
+			if "" != label && (nil == ans[a] ||
+				!canSeeAnnotation(rip, a) ||
+				!ans[a].hasLabel(label)) {
+				return true, nil
+			}
+			if !listable(rip, a) {
+				return true, nil
+			}
+			s, _ := shownAddr(rip, a)
+			as = append(as, s)
+			return true, nil
+		},
+	); nil != err {
+		apiFail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, struct {
+		Addrs []string `json:"addresses"`
+	}{as})
+	debug("%v API list of %v addresses", rip, len(as))
+}
+
+/* apiQueue sends the addresses being scanned and in the queue */
+func apiQueue(w http.ResponseWriter, req *http.Request) {
+	if !apiMethod(w, req, http.MethodGet) {
+		return
+	}
+	rip, ok := apiRequestor(w, req)
+	if !ok {
+		return
+	}
+	ss, qs := queueSnapshot()
+	apiWrite(w, http.StatusOK, struct {
+		Scanning []apiQaddr `json:"scanning"`
+		Queued   []apiQaddr `json:"queued"`
+	}{apiQaddrs(rip, ss), apiQaddrs(rip, qs)})
+	debug("%v API queue", rip)
+}
+
+/* apiDelete deletes the requestor's results */
+func apiDelete(w http.ResponseWriter, req *http.Request) {
+	if !apiMethod(w, req, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if !apiCSRF(w, req) {
+		return
+	}
+	rip, ok := apiRequestor(w, req)
+	if !ok {
+		return
+	}
+	r, err := STORE.Get(rip)
+	if nil != err {
+		apiFail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if nil == r {
+		apiFail(w, http.StatusNotFound, "no scan results for %v", rip)
+		return
+	}
+	if err := removeResult(rip); nil != err {
+		apiFail(w, http.StatusInternalServerError, "%v", err)
+		debug("%v API failed to delete saved results: %v", rip, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	debug("%v API deleted saved results", rip)
+}
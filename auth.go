@@ -0,0 +1,341 @@
+package main
+
+/*
+ * auth.go
+ * Authenticated admin requests over HTTP
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* ADMINHTTPPATH is the URL path, after URLPATH, under which authenticated
+admin requests are served */
+const ADMINHTTPPATH = "/admin/"
+
+/* adminToken is an administrator's bearer token */
+type adminToken struct {
+	name string
+	sum  []byte /* SHA-256 of the token */
+}
+
+/* Administrators, settable with -adminusers and -admintokens */
+var (
+	ADMINUSERS  = make(map[string][]byte) /* bcrypt hashes, by name */
+	ADMINTOKENS []adminToken
+)
+
+/* DUMMYHASH is checked against when there's no such user, so unknown users
+take as long as wrong passwords.  It's made by dummyHash the first time it's
+needed. */
+var (
+	DUMMYHASH     []byte
+	DUMMYHASHONCE = &sync.Once{}
+)
+
+/* Wrong passwords allowed from an address in AUTHFAILWINDOW, after which its
+passwords aren't checked until the window's up */
+const (
+	AUTHMAXFAILS   = 10
+	AUTHFAILWINDOW = 10 * time.Minute
+)
+
+/* AUTHFAILS counts recent wrong passwords, by address */
+var (
+	AUTHFAILS     = make(map[string]*authFails)
+	AUTHFAILSLOCK = &sync.Mutex{}
+)
+
+/* authFails is the number of wrong passwords from an address since start */
+type authFails struct {
+	n     int
+	start time.Time
+}
+
+/* BCRYPTSLOTS limits how many passwords are checked at once, so a flood of
+guesses from many addresses can't hog every CPU */
+var BCRYPTSLOTS = make(chan struct{}, 4)
+
+/* ERRAUTHLIMITED is returned by authenticate when the requestor has had too
+many wrong passwords */
+var ERRAUTHLIMITED = errors.New("too many wrong passwords")
+
+/* adminKey is the context key for an authenticated administrator's
+identity */
+type adminKey struct{}
+
+/* readAdminFile calls f with the name and value from each name:value line in
+the file named fn.  Blank lines and lines starting with # are skipped. */
+func readAdminFile(fn string, f func(name, value string) error) error {
+	fh, err := os.Open(fn)
+	if nil != err {
+		return err
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	var ln int
+	for scanner.Scan() {
+		ln++
+		l := strings.TrimSpace(scanner.Text())
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, ":", 2)
+		if 2 != len(parts) || "" == parts[0] {
+			return fmt.Errorf("line %v: not name:value", ln)
+		}
+		if err := f(parts[0], parts[1]); nil != err {
+			return fmt.Errorf("line %v: %v", ln, err)
+		}
+	}
+	return scanner.Err()
+}
+
+/* loadAdminUsers reads usernames and bcrypt password hashes, in htpasswd
+format, from the file named fn */
+func loadAdminUsers(fn string) error {
+	return readAdminFile(fn, func(name, hash string) error {
+		if _, err := bcrypt.Cost([]byte(hash)); nil != err {
+			return fmt.Errorf("hash for %v: %v", name, err)
+		}
+		ADMINUSERS[name] = []byte(hash)
+		return nil
+	})
+}
+
+/* loadAdminTokens reads names and hex-encoded SHA-256 hashes of bearer
+tokens from the file named fn */
+func loadAdminTokens(fn string) error {
+	return readAdminFile(fn, func(name, sum string) error {
+		b, err := hex.DecodeString(sum)
+		if nil != err || sha256.Size != len(b) {
+			return fmt.Errorf("hash for %v isn't SHA-256", name)
+		}
+		ADMINTOKENS = append(ADMINTOKENS, adminToken{name, b})
+		return nil
+	})
+}
+
+/* adminAuthEnabled returns true if there's any way to authenticate */
+func adminAuthEnabled() bool {
+	return 0 != len(ADMINUSERS) || 0 != len(ADMINTOKENS)
+}
+
+/* authenticate returns the name of the administrator making req, from rip,
+who may give a username and password or a bearer token */
+func authenticate(req *http.Request, rip string) (string, error) {
+	/* Username and password */
+	if u, p, ok := req.BasicAuth(); ok {
+		if !passwordAllowed(rip) {
+			return "", ERRAUTHLIMITED
+		}
+		h, ok := ADMINUSERS[u]
+		if !ok {
+			h = dummyHash()
+		}
+		select {
+		case BCRYPTSLOTS <- struct{}{}:
+		case <-req.Context().Done():
+			return "", req.Context().Err()
+		}
+		err := bcrypt.CompareHashAndPassword(h, []byte(p))
+		<-BCRYPTSLOTS
+		if nil != err || !ok {
+			notePassword(rip, false)
+			return "", fmt.Errorf("bad password for user %q", u)
+		}
+		notePassword(rip, true)
+		return u, nil
+	}
+
+	/* Bearer token */
+	ah := req.Header.Get("Authorization")
+	if "" == ah {
+		return "", fmt.Errorf("no credentials")
+	}
+	scheme, tok, _ := strings.Cut(ah, " ")
+	if !strings.EqualFold("Bearer", scheme) {
+		return "", fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(tok)))
+	var name string
+	for _, at := range ADMINTOKENS {
+		if 1 == subtle.ConstantTimeCompare(sum[:], at.sum) {
+			name = at.name
+		}
+	}
+	if "" == name {
+		return "", fmt.Errorf("unknown token")
+	}
+	return name, nil
+}
+
+/* passwordAllowed returns false if there have been too many wrong passwords
+from rip lately */
+func passwordAllowed(rip string) bool {
+	AUTHFAILSLOCK.Lock()
+	defer AUTHFAILSLOCK.Unlock()
+	f, ok := AUTHFAILS[rip]
+	if !ok {
+		return true
+	}
+	if AUTHFAILWINDOW < time.Since(f.start) {
+		delete(AUTHFAILS, rip)
+		return true
+	}
+	return AUTHMAXFAILS > f.n
+}
+
+/* notePassword notes whether a password from rip was right.  A right one
+forgives the wrong ones. */
+func notePassword(rip string, right bool) {
+	AUTHFAILSLOCK.Lock()
+	defer AUTHFAILSLOCK.Unlock()
+	if right {
+		delete(AUTHFAILS, rip)
+		return
+	}
+
+	/* Forget old failures, so the map doesn't grow forever */
+	now := time.Now()
+	for a, f := range AUTHFAILS {
+		if AUTHFAILWINDOW < now.Sub(f.start) {
+			delete(AUTHFAILS, a)
+		}
+	}
+
+	f, ok := AUTHFAILS[rip]
+	if !ok {
+		f = &authFails{start: now}
+		AUTHFAILS[rip] = f
+	}
+	f.n++
+}
+
+/* dummyHash returns DUMMYHASH, making it if it's not been made yet */
+func dummyHash() []byte {
+	DUMMYHASHONCE.Do(func() {
+		DUMMYHASH, _ = bcrypt.GenerateFromPassword(
+			[]byte("not a password"),
+			bcrypt.DefaultCost,
+		)
+	})
+	return DUMMYHASH
+}
+
+/* isAdmin returns true if req was made by an administrator, either via the
+admin socket or authenticated over HTTP */
+func isAdmin(req *http.Request) bool {
+	_, ok := req.Context().Value(adminKey{}).(string)
+	return ok
+}
+
+/* adminWho returns who made the admin request req, for logging */
+func adminWho(req *http.Request) string {
+	if who, ok := req.Context().Value(adminKey{}).(string); ok {
+		return who
+	}
+	return ADMINSOCKADDR
+}
+
+/* adminHTTP serves ADMINMUX to authenticated administrators.  Requests
+which change things need the same header as the API, so a browser can't be
+tricked into making them with a remembered password. */
+func adminHTTP(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Work out who it is */
+	name, err := authenticate(req, rip)
+	if errors.Is(err, ERRAUTHLIMITED) {
+		w.Header().Set("Retry-After", strconv.Itoa(
+			int(AUTHFAILWINDOW.Seconds()),
+		))
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, "Too many wrong passwords, try later.\n")
+		log.Printf(
+			"%v Admin password not checked for %v %v: %v",
+			rip,
+			req.Method,
+			req.URL.Path,
+			err,
+		)
+		return
+	} else if nil != err {
+		realm := fmt.Sprintf("realm=%q", SITE.Title+" Admin")
+		if 0 != len(ADMINUSERS) {
+			w.Header().Add("WWW-Authenticate", "Basic "+realm)
+		}
+		if 0 != len(ADMINTOKENS) {
+			w.Header().Add("WWW-Authenticate", "Bearer "+realm)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "Authentication required.\n")
+		log.Printf(
+			"%v Admin authentication failed for %v %v: %v",
+			rip,
+			req.Method,
+			req.URL.Path,
+			err,
+		)
+		return
+	}
+	who := fmt.Sprintf("%v@%v", name, rip)
+
+	/* Make sure it's not a browser being tricked */
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		if "" == req.Header.Get(APICSRFHEADER) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, fmt.Sprintf(
+				"%v requests need an %v header.\n",
+				req.Method,
+				APICSRFHEADER,
+			))
+			log.Printf(
+				"%v Refused %v %v without %v",
+				who,
+				req.Method,
+				req.URL.Path,
+				APICSRFHEADER,
+			)
+			return
+		}
+	}
+
+	/* Do what's asked */
+	log.Printf(
+		"%v Admin request %v %v",
+		who,
+		req.Method,
+		req.URL.RequestURI(),
+	)
+	ctx := context.WithValue(req.Context(), adminKey{}, who)
+	http.StripPrefix(URLPATH, ADMINMUX).ServeHTTP(w, req.WithContext(ctx))
+}
@@ -0,0 +1,185 @@
+package main
+
+/*
+ * backup.go
+ * Online database backups
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+/* BACKUPSUMHEADER is the HTTP trailer which holds the hex-encoded SHA256 hash
+of a backup, as sent */
+const BACKUPSUMHEADER = "X-Backup-Sha256"
+
+/* backupper is implemented by Stores which can write a consistent snapshot
+of themselves while in use */
+type backupper interface {
+	/* Backup writes a copy of the Store's database to w, and returns the
+	number of bytes written */
+	Backup(w io.Writer) (int64, error)
+}
+
+/* adminBackup streams a snapshot of the database.  If the gzip query
+parameter is true, the snapshot is gzipped.  The SHA256 hash of the body is
+sent in the BACKUPSUMHEADER trailer. */
+func adminBackup(w http.ResponseWriter, req *http.Request) {
+	/* Make sure we can */
+	b, ok := STORE.(backupper)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, "The database can't be backed up.")
+		return
+	}
+	var gz bool
+	if s := req.URL.Query().Get("gzip"); "" != s {
+		var err error
+		if gz, err = strconv.ParseBool(s); nil != err {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Invalid gzip parameter.")
+			return
+		}
+	}
+
+	/* Set headers */
+	fn := "cgiscan-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	if gz {
+		fn += ".gz"
+	}
+	w.Header().Set("Trailer", BACKUPSUMHEADER)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(
+		"Content-Disposition",
+		"attachment; filename=\""+fn+"\"",
+	)
+
+	/* Send the backup, hashing as we go */
+	h := sha256.New()
+	out := io.MultiWriter(w, h)
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(out)
+		out = zw
+	}
+	n, err := b.Backup(out)
+	if nil == err && nil != zw {
+		err = zw.Close()
+	}
+	if nil != err {
+		/* No checksum tells the client something went wrong */
+		log.Printf("%v Error sending backup: %v", adminWho(req), err)
+		return
+	}
+	w.Header().Set(BACKUPSUMHEADER, hex.EncodeToString(h.Sum(nil)))
+
+	debug("%v Sent %v byte backup", adminWho(req), n)
+}
+
+/* backupCmd implements the backup subcommand */
+func backupCmd(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	var (
+		adminPath = fs.String(
+			"admin",
+			"",
+			"Admin socket `path` of the running cgiscan",
+		)
+		outFile = fs.String(
+			"o",
+			"",
+			"Backup `file`, which must not exist (default stdout)",
+		)
+		gz = fs.Bool(
+			"z",
+			false,
+			"Gzip the backup",
+		)
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v backup -admin path [options]
+
+Makes a consistent backup of a running cgiscan's database via its admin
+socket, and checks the backup's SHA256 hash, which is printed to stderr.
+
+Options:
+`, os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if "" == *adminPath {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	/* Ask for the backup */
+	res, err := adminClient(*adminPath).Get(fmt.Sprintf(
+		"http://cgiscan/admin/backup?gzip=%v",
+		*gz,
+	))
+	if nil != err {
+		log.Fatalf("Unable to request backup: %v", err)
+	}
+	defer res.Body.Close()
+	if http.StatusOK != res.StatusCode {
+		b, _ := io.ReadAll(res.Body)
+		log.Fatalf("Backup failed (%v): %s", res.Status, b)
+	}
+
+	/* Work out where to put it, and how to clean up if it goes wrong */
+	var out io.Writer = os.Stdout
+	fail := log.Fatalf
+	if "" != *outFile {
+		f, err := os.OpenFile(
+			*outFile,
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			0600,
+		)
+		if nil != err {
+			log.Fatalf("Unable to create %v: %v", *outFile, err)
+		}
+		defer f.Close()
+		out = f
+		fail = func(format string, v ...interface{}) {
+			f.Close()
+			os.Remove(*outFile)
+			log.Fatalf(format, v...)
+		}
+	}
+
+	/* Save it and make sure it's what was sent */
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), res.Body)
+	if nil != err {
+		fail("Error receiving backup: %v", err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	switch want := res.Trailer.Get(BACKUPSUMHEADER); want {
+	case "":
+		fail("Backup incomplete, server sent no checksum")
+	case sum:
+		log.Printf("Backed up %v bytes, SHA256 %v", n, sum)
+	default:
+		fail(
+			"Backup corrupt, SHA256 is %v but should be %v",
+			sum,
+			want,
+		)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+/*
+ * badge.go
+ * SVG status badges
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* BADGEPATH is the URL path, after URLPATH, under which badges are served */
+const BADGEPATH = "/badge/"
+
+/* BADGEMAXAGE is how long, in seconds, clients may cache a badge */
+const BADGEMAXAGE = 300
+
+/* Badge colours */
+const (
+	BADGEGOOD    = "#4c1"    /* Only allowed ports open */
+	BADGEINFO    = "#007ec6" /* Ports open, with no allowed ports set */
+	BADGESTALE   = "#fe7d37" /* Last scan too old */
+	BADGEBAD     = "#e05d44" /* Ports open which shouldn't be */
+	BADGEUNKNOWN = "#9f9f9f" /* Never scanned, private, or legacy */
+	BADGELABEL   = "#555"    /* Left half */
+)
+
+/* badgePolicy decides a badge's colour */
+type badgePolicy struct {
+	/* Ports which may be open.  If none are set, any open port is
+	reported as information rather than as bad. */
+	Allowed []int `json:"allowed_ports"`
+	/* Results older than this are stale, 0 for never */
+	MaxAgeDays int `json:"max_age_days"`
+}
+
+/* colour works out a badge's colour for r, scanned age ago */
+func (p badgePolicy) colour(r *result, age time.Duration) string {
+	stale := 0 != p.MaxAgeDays &&
+		time.Duration(p.MaxAgeDays)*24*time.Hour < age
+
+	/* Legacy results don't say which ports were open */
+	if nil != r.Legacy {
+		if stale {
+			return BADGESTALE
+		}
+		return BADGEUNKNOWN
+	}
+
+	/* Ports which shouldn't be open are the most important */
+	if 0 != len(p.Allowed) {
+		allowed := make(map[int]bool, len(p.Allowed))
+		for _, a := range p.Allowed {
+			allowed[a] = true
+		}
+		for _, rp := range r.Ports {
+			if !allowed[rp.Port] {
+				return BADGEBAD
+			}
+		}
+	}
+	if stale {
+		return BADGESTALE
+	}
+	if 0 == len(p.Allowed) && 0 != len(r.Ports) {
+		return BADGEINFO
+	}
+	return BADGEGOOD
+}
+
+/* badgeAge turns age into something short, like 3d */
+func badgeAge(age time.Duration) string {
+	switch {
+	case time.Minute > age:
+		return "just now"
+	case time.Hour > age:
+		return fmt.Sprintf("%vm ago", int(age/time.Minute))
+	case 24*time.Hour > age:
+		return fmt.Sprintf("%vh ago", int(age/time.Hour))
+	default:
+		return fmt.Sprintf("%vd ago", int(age/(24*time.Hour)))
+	}
+}
+
+/* badgeText returns the message and colour for a badge for an address whose
+latest result is r, which may be nil */
+func badgeText(r *result, now time.Time) (string, string) {
+	if nil == r {
+		return "not scanned", BADGEUNKNOWN
+	}
+	age := now.Sub(r.End)
+	msg := "last scanned " + badgeAge(age)
+	if nil == r.Legacy {
+		s := "s"
+		if 1 == len(r.Ports) {
+			s = ""
+		}
+		msg = fmt.Sprintf("%v open port%v, %v", len(r.Ports), s, msg)
+	}
+	return msg, SITE.Badge.colour(r, age)
+}
+
+/* badgeTextWidth estimates how wide s is, in pixels, in the badge's font */
+func badgeTextWidth(s string) int { return 7*len(s) + 10 }
+
+/* xmlEscape escapes s for use in XML text and attributes */
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+/* writeBadge writes a badge with label on the left and msg on the right, in
+colour c */
+func writeBadge(w io.Writer, label, msg, c string) error {
+	lw, mw := badgeTextWidth(label), badgeTextWidth(msg)
+	label, msg = xmlEscape(label), xmlEscape(msg)
+	_, err := fmt.Fprintf(
+		w,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]v" height="20" `+
+			`role="img" aria-label="%[3]v: %[4]v">
+<title>%[3]v: %[4]v</title>
+<linearGradient id="s" x2="0" y2="100%%">
+<stop offset="0" stop-color="#bbb" stop-opacity=".1"/>
+<stop offset="1" stop-opacity=".1"/>
+</linearGradient>
+<clipPath id="r"><rect width="%[1]v" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="%[2]v" height="20" fill="%[6]v"/>
+<rect x="%[2]v" width="%[5]v" height="20" fill="%[7]v"/>
+<rect width="%[1]v" height="20" fill="url(#s)"/>
+</g>
+<g fill="#fff" text-anchor="middle" `+
+			`font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[8]v" y="14">%[3]v</text>
+<text x="%[9]v" y="14">%[4]v</text>
+</g>
+</svg>
+`,
+		lw+mw,
+		lw,
+		label,
+		msg,
+		mw,
+		BADGELABEL,
+		c,
+		lw/2,
+		lw+mw/2,
+	)
+	return err
+}
+
+/* sendBadge sends an SVG badge for the address in the URL, which must end in
+.svg, showing the number of open ports and age of its latest result, or that
+it's private if the requestor may not see its results */
+func sendBadge(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Work out for which address */
+	a := strings.TrimPrefix(req.URL.Path, URLPATH+BADGEPATH)
+	if !strings.HasSuffix(a, ".svg") {
+		http.NotFound(w, req)
+		return
+	}
+	a = strings.TrimSuffix(a, ".svg")
+	if nil == net.ParseIP(a) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "The URL must end in /badge/<address>.svg.")
+		return
+	}
+
+	/* Make the badge, if the requestor may see a's results */
+	msg, c := "private", BADGEUNKNOWN
+	if canSee(rip, a) {
+		r, err := STORE.Get(a)
+		if nil != err {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+		msg, c = badgeText(r, time.Now())
+	}
+	var b bytes.Buffer
+	if err := writeBadge(
+		&b,
+		strings.ToLower(SITE.Title),
+		msg,
+		c,
+	); nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Send it, letting clients and proxies cache it a bit.  The age
+	changes even if the result doesn't, so there's no Last-Modified. */
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set(
+		"Cache-Control",
+		fmt.Sprintf("max-age=%v", BADGEMAXAGE),
+	)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(b.Bytes())))
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(b.Bytes()))
+	debug("%v Sent badge for %v: %v", rip, a, msg)
+}
@@ -0,0 +1,291 @@
+package main
+
+/*
+ * boltstore.go
+ * Store results in a bolt database
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/* Bucket names */
+const (
+	RESBUCKET  = "Results" /* Latest result for each address */
+	HISTBUCKET = "History" /* Bucket of results for each address */
+)
+
+/* boltStore is a Store backed by a bolt database */
+type boltStore struct {
+	db *bolt.DB
+}
+
+/* openBoltStore opens the bolt database at path and makes sure it has the
+buckets it needs.  If timeout is nonzero, it gives up after waiting that long
+for another process to close the database. */
+func openBoltStore(path string, timeout time.Duration) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if nil != err {
+		return nil, err
+	}
+
+	/* Make sure we have buckets in the database */
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bn := range []string{RESBUCKET, HISTBUCKET} {
+			if _, err := tx.CreateBucketIfNotExists(
+				[]byte(bn),
+			); nil != err {
+				return fmt.Errorf(
+					"unable to create bucket %s: %v",
+					bn,
+					err,
+				)
+			}
+		}
+		return nil
+	}); nil != err {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+/* Save implements Store.Save */
+func (s *boltStore) Save(r *result) error {
+	r.setID()
+	v, err := encodeResult(r)
+	if nil != err {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(RESBUCKET)).Put(
+			[]byte(r.Addr),
+			v,
+		); nil != err {
+			return err
+		}
+		hb, err := tx.Bucket(
+			[]byte(HISTBUCKET),
+		).CreateBucketIfNotExists([]byte(r.Addr))
+		if nil != err {
+			return err
+		}
+		return hb.Put([]byte(r.ID), v)
+	})
+}
+
+/* Get implements Store.Get */
+func (s *boltStore) Get(a string) (*result, error) {
+	var r *result
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(RESBUCKET)).Get([]byte(a))
+		/* Return nil if there's no previous scan */
+		if nil == v {
+			return nil
+		}
+		var err error
+		r, err = decodeResult(a, v)
+		return err
+	})
+	return r, err
+}
+
+/* List implements Store.List */
+func (s *boltStore) List(f func(r *result) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(RESBUCKET)).ForEach(
+			func(k, v []byte) error {
+				r, err := decodeResult(string(k), v)
+				if nil != err {
+					return fmt.Errorf(
+						"decoding result for %s: %v",
+						k,
+						err,
+					)
+				}
+				return f(r)
+			},
+		)
+	})
+}
+
+/* Delete implements Store.Delete */
+func (s *boltStore) Delete(a string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(RESBUCKET)).Delete(
+			[]byte(a),
+		); nil != err {
+			return err
+		}
+		hb := tx.Bucket([]byte(HISTBUCKET))
+		if nil == hb.Bucket([]byte(a)) {
+			return nil
+		}
+		return hb.DeleteBucket([]byte(a))
+	})
+}
+
+/* History implements Store.History.  Addresses scanned before history was
+kept have only their latest result. */
+func (s *boltStore) History(a string) ([]*result, error) {
+	var rs []*result
+	err := s.db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(HISTBUCKET)).Bucket([]byte(a))
+		/* Older databases only have the latest result */
+		if nil == hb {
+			v := tx.Bucket([]byte(RESBUCKET)).Get([]byte(a))
+			if nil == v {
+				return nil
+			}
+			r, err := decodeResult(a, v)
+			if nil != err {
+				return err
+			}
+			rs = append(rs, r)
+			return nil
+		}
+		return hb.ForEach(func(k, v []byte) error {
+			r, err := decodeResult(a, v)
+			if nil != err {
+				return fmt.Errorf(
+					"decoding result %s for %v: %v",
+					k,
+					a,
+					err,
+				)
+			}
+			rs = append(rs, r)
+			return nil
+		})
+	})
+	return rs, err
+}
+
+/* PutKV implements Store.PutKV */
+func (s *boltStore) PutKV(bucket, k string, v []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if nil != err {
+			return err
+		}
+		return b.Put([]byte(k), v)
+	})
+}
+
+/* GetKV implements Store.GetKV */
+func (s *boltStore) GetKV(bucket, k string) ([]byte, error) {
+	var v []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if nil == b {
+			return nil
+		}
+		/* Copy the data to a returnable slice */
+		if bv := b.Get([]byte(k)); nil != bv {
+			v = make([]byte, len(bv))
+			copy(v, bv)
+		}
+		return nil
+	})
+	return v, err
+}
+
+/* DeleteKV implements Store.DeleteKV */
+func (s *boltStore) DeleteKV(bucket, k string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if nil == b {
+			return nil
+		}
+		return b.Delete([]byte(k))
+	})
+}
+
+/* ForEachKV implements Store.ForEachKV */
+func (s *boltStore) ForEachKV(
+	bucket string,
+	f func(k string, v []byte) error,
+) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if nil == b {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return f(string(k), v)
+		})
+	})
+}
+
+/* ForEachKVFrom implements Store.ForEachKVFrom */
+func (s *boltStore) ForEachKVFrom(
+	bucket, from string,
+	desc bool,
+	f func(k string, v []byte) error,
+) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if nil == b {
+			return nil
+		}
+
+		/* Find the first key */
+		var (
+			c    = b.Cursor()
+			k, v []byte
+		)
+		switch {
+		case "" == from && desc:
+			k, v = c.Last()
+		case "" == from:
+			k, v = c.First()
+		default:
+			k, v = c.Seek([]byte(from))
+			if desc && nil == k {
+				k, v = c.Last()
+			} else if desc && string(k) > from {
+				k, v = c.Prev()
+			}
+		}
+
+		/* Walk from it */
+		for nil != k {
+			if err := f(string(k), v); nil != err {
+				return err
+			}
+			if desc {
+				k, v = c.Prev()
+			} else {
+				k, v = c.Next()
+			}
+		}
+		return nil
+	})
+	if ERRSTOPWALK == err {
+		return nil
+	}
+	return err
+}
+
+/* Backup implements backupper.Backup.  It writes the database from within a
+read transaction, so writes may continue while it runs. */
+func (s *boltStore) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+/* Close implements Store.Close */
+func (s *boltStore) Close() error { return s.db.Close() }
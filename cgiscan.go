@@ -5,34 +5,58 @@ package main
  * CGI program to synscan and banner the requestor
  * By J. Stuart McMurray
  * Created 20160704
- * Last Modified 20160708
+ * Last Modified 20261018
  */
 
 import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/fcgi"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 /* Globals */
-const RESBUCKET = "Results" /* Bucket name for results */
 var (
 	debug   func(string, ...interface{}) /* Debug function */
-	DB      *bolt.DB                     /* Scan database */
+	STORE   Store                        /* Scan results */
 	START   = time.Now()                 /* Server start time */
 	URLPATH string                       /* Leading bit of URL */
 )
 
 func main() {
+	/* Subcommands have their own flags */
+	if 1 < len(os.Args) {
+		switch os.Args[1] {
+		case "export":
+			exportCmd(os.Args[2:])
+			return
+		case "import":
+			importCmd(os.Args[2:])
+			return
+		case "search":
+			searchCmd(os.Args[2:])
+			return
+		case "backup":
+			backupCmd(os.Args[2:])
+			return
+		case "verify":
+			verifyCmd(os.Args[2:])
+			return
+		case "annotate":
+			annotateCmd(os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		path = flag.String(
 			"p",
@@ -60,6 +84,12 @@ func main() {
 			"/run/cgiscan/cgiscan.db",
 			"Database `file`",
 		)
+		storeKind = flag.String(
+			"store",
+			"bolt",
+			"Result storage `type`, one of "+
+				strings.Join(STORES, ", "),
+		)
 		nAttempt = flag.Uint(
 			"n",
 			128,
@@ -70,6 +100,34 @@ func main() {
 			false,
 			"Serve HTTPS instead of FastCGI",
 		)
+		serveHTTP = flag.Bool(
+			"http",
+			false,
+			"Serve cleartext HTTP instead of FastCGI",
+		)
+		redirectAddr = flag.String(
+			"redirect",
+			"",
+			"Optional `address` on which to listen for cleartext "+
+				"HTTP and redirect to HTTPS, if -https is given",
+		)
+		offerHTTP2 = flag.Bool(
+			"http2",
+			true,
+			"Offer HTTP/2 if -https is given",
+		)
+		stall = flag.Duration(
+			"stall",
+			SCANNERSTALL,
+			"Report the scanner unhealthy if it's made no "+
+				"progress for this `duration`",
+		)
+		metricsAddr = flag.String(
+			"metrics",
+			"",
+			"Optional `address` on which to serve Prometheus "+
+				"metrics over HTTP, instead of with the pages",
+		)
 		certFile = flag.String(
 			"cert",
 			"cert.pem",
@@ -85,16 +143,81 @@ func main() {
 			"",
 			"Unix domain socket path for local queuing",
 		)
+		sigKeyFile = flag.String(
+			"sigkey",
+			"/run/cgiscan/signing.pem",
+			"Ed25519 report signing key `file`, which will be "+
+				"generated if it doesn't exist; may be \"\" "+
+				"to disable signing",
+		)
+		adminPath = flag.String(
+			"admin",
+			"",
+			"Unix domain socket `path` for administrative requests",
+		)
+		adminUsers = flag.String(
+			"adminusers",
+			"",
+			"Optional htpasswd `file` with bcrypt-hashed passwords "+
+				"for administrative requests over HTTP",
+		)
+		adminTokens = flag.String(
+			"admintokens",
+			"",
+			"Optional `file` with name:SHA-256 lines of bearer "+
+				"tokens for administrative requests over HTTP",
+		)
+		visibility = flag.String(
+			"visibility",
+			VISPUBLIC,
+			"Who may see an address' results, one of "+
+				VISPUBLIC+", "+VISREQUESTOR+" (only the "+
+				"address itself), or "+VISADMIN,
+		)
+		listAddrs = flag.String(
+			"listaddrs",
+			ADDRSFULL,
+			"How addresses are shown in lists, one of "+
+				ADDRSFULL+", "+ADDRSTRUNCATED+", or "+
+				ADDRSHASHED,
+		)
+		templateDir = flag.String(
+			"templates",
+			"",
+			"Optional `directory` with HTML templates to use "+
+				"instead of the built-in ones",
+		)
+		siteFile = flag.String(
+			"site",
+			"",
+			"Optional JSON site configuration `file` with the "+
+				"title, operator, contact, abuse, terms, "+
+				"and stylesheet",
+		)
+		staticDir = flag.String(
+			"static",
+			"",
+			"Optional `directory` with static files to serve "+
+				"instead of the built-in ones",
+		)
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(
 			os.Stderr,
 			`Usage: %v [options]
+       %v export|import|search|backup|verify|annotate [options]
 
-Listens for FastCGI connections to serve up a scanning service.
+Listens for FastCGI, HTTP, or HTTPS connections to serve up a scanning service.
+
+Stored results may be exported or imported as JSON Lines with the export and
+import subcommands, and searched with the search subcommand.  The backup
+subcommand makes a backup of a running cgiscan's database via its admin
+socket.  Signed reports may be checked with the verify subcommand.  Addresses
+may be given labels, owners, and notes with the annotate subcommand.  Pass -h
+to any of them for more details.
 
 Options:
-`, os.Args[0],
+`, os.Args[0], os.Args[0],
 		)
 		flag.PrintDefaults()
 	}
@@ -113,47 +236,115 @@ Options:
 		debug = func(string, ...interface{}) {}
 	}
 
+	SCANNERSTALL = *stall
+	if err := setVisibility(*visibility, *listAddrs); nil != err {
+		log.Fatalf("Invalid privacy settings: %v", err)
+	}
+
+	/* Make sure we've a sensible way to serve */
+	if *serveHTTP && *serveHTTPS {
+		log.Fatalf("Only one of -http and -https may be given")
+	}
+	if "" != *redirectAddr && !*serveHTTPS {
+		log.Fatalf("HTTPS redirects need -https")
+	}
+
 	/* Register handlers */
-	if "/" == *path {
-		http.HandleFunc("/", status)
-	} else {
+	if "/" != *path {
 		URLPATH = *path
-		http.HandleFunc(URLPATH, status)
 	}
-	http.HandleFunc(URLPATH+"/status", status)
-	http.HandleFunc(URLPATH+"/scan", handleScan)
-	http.HandleFunc(URLPATH+"/res/", query)
-	http.HandleFunc(URLPATH+"/list", listScanned)
-	http.HandleFunc(URLPATH+"/delete", deleteResult)
-	http.HandleFunc(URLPATH+"/help", help)
-	http.HandleFunc(URLPATH+"/queue", sendQueue)
+	registerRoutes()
+
+	/* Serve them over HTTP as well, if admins can authenticate */
+	if "" != *adminUsers {
+		if err := loadAdminUsers(*adminUsers); nil != err {
+			log.Fatalf(
+				"Unable to load admin users from %v: %v",
+				*adminUsers,
+				err,
+			)
+		}
+	}
+	if "" != *adminTokens {
+		if err := loadAdminTokens(*adminTokens); nil != err {
+			log.Fatalf(
+				"Unable to load admin tokens from %v: %v",
+				*adminTokens,
+				err,
+			)
+		}
+	}
+	if adminAuthEnabled() {
+		http.HandleFunc(URLPATH+ADMINHTTPPATH, adminHTTP)
+		log.Printf(
+			"Serving admin requests under %v for %v users "+
+				"and %v tokens",
+			URLPATH+ADMINHTTPPATH,
+			len(ADMINUSERS),
+			len(ADMINTOKENS),
+		)
+		if *serveHTTP {
+			log.Printf("WARNING: Admin credentials will be sent " +
+				"in cleartext")
+		}
+	}
+
+	/* Work out how the site looks */
+	if "" != *siteFile {
+		if err := loadSiteConfig(*siteFile); nil != err {
+			log.Fatalf(
+				"Unable to load site configuration from %v: %v",
+				*siteFile,
+				err,
+			)
+		}
+	}
+	STATICDIR = *staticDir
+
+	/* Load page templates */
+	if err := loadTemplates(*templateDir); nil != err {
+		log.Fatalf("Unable to load templates: %v", err)
+	}
 
 	/* Open Database */
 	var err error
-	DB, err = bolt.Open(*dbFile, 0600, nil)
-	if nil != err {
+	if STORE, err = openStore(*storeKind, *dbFile, 0); nil != err {
 		log.Fatalf("Unable to open database %v: %v", *dbFile, err)
 	}
+	if err := loadStats(); nil != err {
+		log.Fatalf("Unable to load statistics: %v", err)
+	}
+	if err := restoreQueue(); nil != err {
+		log.Fatalf("Unable to restore queue: %v", err)
+	}
+	if err := fillLatestPorts(); nil != err {
+		log.Fatalf("Unable to save latest ports for searching: %v", err)
+	}
+	if hiddenAddrs() {
+		if err := loadAddrHashKey(); nil != err {
+			log.Fatalf("Unable to load address hash key: %v", err)
+		}
+	}
+	if err := fillListOrder(); nil != err {
+		log.Fatalf("Unable to put addresses in list order: %v", err)
+	}
 
-	/* Make sure we have a bucket in the database */
-	bn := []byte(RESBUCKET)
-	DB.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bn)
-		return err
-	})
-	if err != nil {
-		log.Fatalf(
-			"Unable to create bucket %s in database: %v",
-			bn,
-			err,
-		)
+	/* Get the key with which to sign reports */
+	if "" != *sigKeyFile {
+		if err := loadSigningKey(*sigKeyFile); nil != err {
+			log.Fatalf(
+				"Unable to load signing key from %v: %v",
+				*sigKeyFile,
+				err,
+			)
+		}
 	}
 
 	/* Listen for FastCGI connections */
 	var l net.Listener
 	if "-" == *sock {
-		if *serveHTTPS {
-			log.Fatalf("Can't serve https via stdio")
+		if *serveHTTPS || *serveHTTP {
+			log.Fatalf("Can't serve http or https via stdio")
 		}
 		log.Printf("Listening on standard i/o")
 	} else if *tcp {
@@ -166,19 +357,43 @@ Options:
 	}
 	if nil != l {
 		log.Printf("Listening on %v", l.Addr())
+		expectListener("main")
+		listenerUp("main", l)
+	}
+
+	/* Maybe redirect cleartext HTTP to HTTPS */
+	if "" != *redirectAddr {
+		expectListener("redirect")
+		go redirectToHTTPS(*redirectAddr, l.Addr())
+	}
+
+	/* Maybe serve metrics separately */
+	if "" != *metricsAddr {
+		METRICSPRIVATE = true
+		expectListener("metrics")
+		go metricsListener(*metricsAddr)
 	}
 
 	/* Maybe listen for local queues, as well */
 	if "" != *qsockPath {
+		expectListener("queue")
 		go qsock(*qsockPath)
 	}
 
+	/* Maybe listen for admin requests */
+	if "" != *adminPath {
+		expectListener("admin")
+		go adminSock(*adminPath)
+	}
+
 	/* Start scanner */
 	go scanner(*nAttempt)
 
-	/* Serve up HTTPS or FastCGI */
+	/* Serve up HTTPS, HTTP, or FastCGI */
 	if *serveHTTPS {
-		err = https(l, *certFile, *keyFile)
+		err = https(l, *certFile, *keyFile, *offerHTTP2)
+	} else if *serveHTTP {
+		err = http.Serve(l, nil)
 	} else {
 		err = fcgi.Serve(l, nil)
 	}
@@ -190,6 +405,68 @@ Options:
 	log.Printf("Done.  This is a bug.")
 }
 
+/* registerRoutes registers the handlers for every route, under URLPATH, and
+the admin handlers on ADMINMUX */
+func registerRoutes() {
+	route("", status, http.MethodGet)
+	route("/status", status, http.MethodGet)
+	route("/scan", handleScan, http.MethodGet, http.MethodPost)
+	route("/res/", query, http.MethodGet)
+	route("/list", listScanned, http.MethodGet)
+	route("/delete", deleteResult, http.MethodGet, http.MethodPost)
+	route("/share", handleShare, http.MethodGet, http.MethodPost)
+	route("/unshare", handleUnshare, http.MethodGet, http.MethodPost)
+	route(SHAREPATH, sharedResult, http.MethodGet)
+	route(BADGEPATH, sendBadge, http.MethodGet)
+	route("/metrics", sendMetrics, http.MethodGet)
+	route("/healthz", healthz, http.MethodGet)
+	route("/readyz", readyz, http.MethodGet)
+	route("/help", help, http.MethodGet)
+	route("/queue", sendQueue, http.MethodGet)
+	route("/stats", stats, http.MethodGet)
+	route("/search", handleSearch, http.MethodGet)
+	route("/port/", portHosts, http.MethodGet)
+	route("/ports", topPorts, http.MethodGet)
+	route("/events", events, http.MethodGet)
+	route(STATICPATH, sendStatic, http.MethodGet)
+	route(PUBKEYPATH, sendPublicKey, http.MethodGet)
+	route(OPENAPIPATH, sendOpenAPI, http.MethodGet)
+	route(APIPATH+"/", apiNotFound)
+	route(APIPATH+"/status", apiStatusHandler, http.MethodGet)
+	route(APIPATH+"/scan", apiScan, http.MethodPost)
+	route(APIPATH+"/res/", apiRes, http.MethodGet)
+	route(APIPATH+"/list", apiList, http.MethodGet)
+	route(APIPATH+"/queue", apiQueue, http.MethodGet)
+	route(APIPATH+"/delete", apiDelete, http.MethodPost, http.MethodDelete)
+
+	/* Admin handlers */
+	adminRoute("/admin/export", adminExport, http.MethodGet)
+	adminRoute("/admin/import", adminImport, http.MethodPost)
+	adminRoute("/admin/search", adminSearch, http.MethodGet)
+	adminRoute("/admin/backup", adminBackup, http.MethodGet)
+	adminRoute(
+		"/admin/annotate",
+		adminAnnotate,
+		http.MethodGet,
+		http.MethodPost,
+	)
+	adminRoute(
+		"/admin/delete",
+		adminDelete,
+		http.MethodPost,
+		http.MethodDelete,
+	)
+	adminRoute(
+		"/admin/queue",
+		adminQueue,
+		http.MethodGet,
+		http.MethodPost,
+		http.MethodDelete,
+	)
+	adminRoute(ADMINVIEWPATH+"/res/", adminView(query), http.MethodGet)
+	adminRoute(ADMINVIEWPATH+"/port/", adminView(portHosts), http.MethodGet)
+}
+
 /* ListenUnix tries to listen on a unix socket.  If successful, it sets the
 permissions of the socket to perm.  The socket will be removed if it exists. */
 func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
@@ -212,20 +489,76 @@ func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
 	return l, nil
 }
 
-/* https serves up HTTPS responses, as opposed to FCGI */
-func https(l net.Listener, certFile, keyFile string) error {
-	/* Load cert and key */
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+/* https serves up HTTPS responses, as opposed to FCGI.  HTTP/2 is offered if
+h2 is true. */
+func https(l net.Listener, certFile, keyFile string, h2 bool) error {
+	srv := &http.Server{}
+	if !h2 {
+		/* A non-nil, empty map turns off HTTP/2 */
+		srv.TLSNextProto = make(map[string]func(
+			*http.Server,
+			*tls.Conn,
+			http.Handler,
+		))
+	}
+	return srv.ServeTLS(l, certFile, keyFile)
+}
+
+/* redirectToHTTPS listens for cleartext HTTP on addr and redirects requests
+to the same URL over HTTPS, served on a listener with the address ha */
+func redirectToHTTPS(addr string, ha net.Addr) {
+	/* Work out the HTTPS port, if it's not the default */
+	var port string
+	if ta, ok := ha.(*net.TCPAddr); ok && 443 != ta.Port {
+		port = strconv.Itoa(ta.Port)
+	}
+
+	l, err := net.Listen("tcp", addr)
 	if nil != err {
-		return err
+		log.Fatalf(
+			"Unable to listen for HTTP to redirect on %v: %v",
+			addr,
+			err,
+		)
 	}
+	log.Printf("Redirecting HTTP on %v to HTTPS", l.Addr())
+	listenerUp("redirect", l)
 
-	/* Upgrade listener to a TLS'd listener */
-	tl := tls.NewListener(l, &tls.Config{
-		Certificates: []tls.Certificate{cert},
-	})
+	err = http.Serve(l, http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			/* Swap the port in the Host header for ours */
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); nil == err {
+				host = h
+			}
+			host = strings.TrimSuffix(strings.TrimPrefix(
+				host,
+				"[",
+			), "]")
+			if "" == host {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "Host header required.")
+				return
+			}
+			if "" != port || strings.Contains(host, ":") {
+				host = net.JoinHostPort(host, port)
+				host = strings.TrimSuffix(host, ":")
+			}
 
-	return http.Serve(tl, nil)
+			/* Send the client to the same place, but secure */
+			u := *req.URL
+			u.Scheme = "https"
+			u.Host = host
+			http.Redirect(
+				w,
+				req,
+				u.String(),
+				http.StatusPermanentRedirect,
+			)
+			debug("%v Redirected to %v", req.RemoteAddr, u.String())
+		},
+	))
+	log.Fatalf("Error redirecting HTTP to HTTPS: %v", err)
 }
 
 /* TODO: Max queue length */
@@ -0,0 +1,144 @@
+package main
+
+/*
+ * csrf.go
+ * Cross-site request forgery protection
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* CSRFLIFETIME is how long a CSRF token is good */
+const CSRFLIFETIME = time.Hour
+
+/* CSRFFIELD is the name of the form field which holds the CSRF token */
+const CSRFFIELD = "csrf"
+
+/* APICSRFHEADER must be sent with API requests which change things.  Browsers
+won't send custom headers cross-origin without a CORS preflight, which we never
+allow. */
+const APICSRFHEADER = "X-CGIScan-API"
+
+/* CSRFKEY is the key with which CSRF tokens are made.  A new one is made on
+startup, which invalidates old tokens. */
+var CSRFKEY = make([]byte, sha256.Size)
+
+func init() {
+	if _, err := rand.Read(CSRFKEY); nil != err {
+		panic(fmt.Sprintf("generating CSRF key: %v", err))
+	}
+}
+
+/* csrfMAC returns the MAC for a token for the requestor at address a to take
+action, expiring at exp */
+func csrfMAC(a, action string, exp int64) []byte {
+	m := hmac.New(sha256.New, CSRFKEY)
+	fmt.Fprintf(m, "%v\x00%v\x00%v", a, action, exp)
+	return m.Sum(nil)
+}
+
+/* csrfToken returns a token which allows the requestor at address a to take
+action for the next CSRFLIFETIME */
+func csrfToken(a, action string) string {
+	exp := time.Now().Add(CSRFLIFETIME).Unix()
+	return strconv.FormatInt(exp, 10) + "." +
+		base64.RawURLEncoding.EncodeToString(csrfMAC(a, action, exp))
+}
+
+/* checkCSRFToken makes sure tok is a current token for the requestor at
+address a to take action */
+func checkCSRFToken(a, action, tok string) error {
+	if "" == tok {
+		return fmt.Errorf("missing CSRF token")
+	}
+	es, ms, ok := strings.Cut(tok, ".")
+	if !ok {
+		return fmt.Errorf("malformed CSRF token")
+	}
+	exp, err := strconv.ParseInt(es, 10, 64)
+	if nil != err {
+		return fmt.Errorf("malformed CSRF token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(ms)
+	if nil != err {
+		return fmt.Errorf("malformed CSRF token")
+	}
+	if !hmac.Equal(mac, csrfMAC(a, action, exp)) {
+		return fmt.Errorf("invalid CSRF token")
+	}
+	if time.Now().Unix() > exp {
+		return fmt.Errorf("expired CSRF token")
+	}
+	return nil
+}
+
+/* confirmPage is what's needed to render a form asking the requestor to
+confirm an action */
+type confirmPage struct {
+	Title  string
+	Prompt string
+	Action string /* URL path, after URLPATH, to which to POST */
+	Button string
+	Token  string
+	Fields map[string]string /* Hidden form fields */
+}
+
+/* confirmOrCheck handles the requestor at address rip asking to take action
+by requesting the URL path action, after URLPATH.  GET requests are sent a form
+to confirm the action, and POST requests must have a CSRF token from the form.
+If confirmOrCheck returns false, a response has been sent and the action should
+not be taken. */
+func confirmOrCheck(
+	w http.ResponseWriter,
+	req *http.Request,
+	rip string,
+	action string,
+	page confirmPage,
+) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		page.Action = action
+		page.Token = csrfToken(rip, action)
+		if err := renderPage(w, "confirm.html", page); nil != err {
+			return false
+		}
+		debug("%v Sent confirmation form for %v", rip, action)
+		return false
+	case http.MethodPost:
+		err := checkCSRFToken(rip, action, req.PostFormValue(CSRFFIELD))
+		if nil != err {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Request refused: %v.\n", err)
+			debug("%v Refused POST to %v: %v", rip, action, err)
+			return false
+		}
+		return true
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method %v not allowed.\n", req.Method)
+		return false
+	}
+}
+
+/* apiCSRF makes sure an API request which changes things has APICSRFHEADER.
+If not, it sends back an error and returns false. */
+func apiCSRF(w http.ResponseWriter, req *http.Request) bool {
+	if "" != req.Header.Get(APICSRFHEADER) {
+		return true
+	}
+	apiFail(w, http.StatusForbidden, "missing %v header", APICSRFHEADER)
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+/*
+ * csrf_test.go
+ * Make sure CSRF tokens are only good for who and what they were made
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSRFToken(t *testing.T) {
+	const (
+		a      = "192.0.2.1"
+		action = "/delete"
+	)
+	tok := csrfToken(a, action)
+	if err := checkCSRFToken(a, action, tok); nil != err {
+		t.Fatalf("Fresh token refused: %v", err)
+	}
+
+	/* Tokens are bound to the requestor and the action */
+	if nil == checkCSRFToken("192.0.2.2", action, tok) {
+		t.Errorf("Token accepted for another address")
+	}
+	if nil == checkCSRFToken(a, "/share", tok) {
+		t.Errorf("Token accepted for another action")
+	}
+
+	/* Changing the expiry breaks the MAC */
+	exp := time.Now().Add(2 * CSRFLIFETIME).Unix()
+	_, mac, _ := strings.Cut(tok, ".")
+	if nil == checkCSRFToken(
+		a,
+		action,
+		strconv.FormatInt(exp, 10)+"."+mac,
+	) {
+		t.Errorf("Token with changed expiry accepted")
+	}
+
+	/* Expired tokens, properly made, are refused */
+	exp = time.Now().Add(-time.Minute).Unix()
+	old := strconv.FormatInt(exp, 10) + "." +
+		base64.RawURLEncoding.EncodeToString(csrfMAC(a, action, exp))
+	if err := checkCSRFToken(a, action, old); nil == err {
+		t.Errorf("Expired token accepted")
+	} else if want := "expired CSRF token"; want != err.Error() {
+		t.Errorf("Expired token: got %q, want %q", err, want)
+	}
+
+	/* As is rubbish */
+	for _, bad := range []string{"", "x", "x.y", "1.!!", "1." + mac} {
+		if nil == checkCSRFToken(a, action, bad) {
+			t.Errorf("Bad token %q accepted", bad)
+		}
+	}
+}
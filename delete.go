@@ -5,19 +5,19 @@ package main
  * Delete a saved scan
  * By J. Stuart McMurray
  * Created 20160706
- * Last Modified 20160706
+ * Last Modified 20261018
  */
 
 import (
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
-
-	"github.com/boltdb/bolt"
 )
 
-/* deleteResult removes scan results from the database */
+/* deleteResult removes scan results from the database.  Results are only
+removed for POSTs with a CSRF token; GETs get a form to confirm the deletion. */
 func deleteResult(w http.ResponseWriter, req *http.Request) {
 	/* Get the requestor's address */
 	rip, _, err := net.SplitHostPort(req.RemoteAddr)
@@ -26,19 +26,23 @@ func deleteResult(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, err.Error())
 		return
 	}
+	/* Make sure the requestor really meant it */
+	if !confirmOrCheck(w, req, rip, "/delete", confirmPage{
+		Title:  "Delete",
+		Prompt: fmt.Sprintf("Delete all saved results for %v?", rip),
+		Button: "Delete",
+	}) {
+		return
+	}
 	/* Remove entry from the database */
-	err = DB.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(RESBUCKET))
-		r := []byte(rip)
-		/* If we don't have saved results, give up */
-		if nil == bucket.Get(r) {
-			return fmt.Errorf(
-				"No scan result to delete for %v",
-				rip,
-			)
-		}
-		return bucket.Delete([]byte(rip))
-	})
+	res, err := STORE.Get(rip)
+	/* If we don't have saved results, give up */
+	if nil == err && nil == res {
+		err = fmt.Errorf("No scan result to delete for %v", rip)
+	}
+	if nil == err {
+		err = removeResult(rip)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(w, err.Error())
@@ -49,3 +53,47 @@ func deleteResult(w http.ResponseWriter, req *http.Request) {
 	debug("%v Deleted saved results", rip)
 
 }
+
+/* adminDelete removes the results for the address in the address parameter.
+Unlike /delete, any address' results may be removed. */
+func adminDelete(w http.ResponseWriter, req *http.Request) {
+	if http.MethodPost != req.Method && http.MethodDelete != req.Method {
+		w.Header().Set("Allow", "DELETE, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "Deletions must be POSTed or DELETEd.\n")
+		return
+	}
+
+	/* Work out the address */
+	ip := net.ParseIP(req.FormValue("address"))
+	if nil == ip {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Invalid or missing address.")
+		return
+	}
+	a := ip.String()
+
+	/* Remove its results, if it has any */
+	res, err := STORE.Get(a)
+	if nil == err && nil == res {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, fmt.Sprintf("No scan results for %v.\n", a))
+		return
+	}
+	if nil == err {
+		err = removeResult(a)
+	}
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		log.Printf(
+			"%v Failed to delete saved results for %v: %v",
+			adminWho(req),
+			a,
+			err,
+		)
+		return
+	}
+	io.WriteString(w, fmt.Sprintf("Deleted saved results for %v.\n", a))
+	log.Printf("%v Deleted saved results for %v", adminWho(req), a)
+}
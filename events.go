@@ -0,0 +1,190 @@
+package main
+
+/*
+ * events.go
+ * Server-Sent Events for queue position and scan progress
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* EVENTKEEPALIVE is how often a comment is sent down an otherwise idle event
+stream, to keep proxies from closing it */
+const EVENTKEEPALIVE = 15 * time.Second
+
+/* EVENTBUFFER is the number of events which may wait for a slow client.
+Events past that are dropped. */
+const EVENTBUFFER = 64
+
+/* event is a single event to send to a client */
+type event struct {
+	name string
+	data interface{}
+}
+
+/* eventState is sent as a state event when an address' place in the queue
+changes or its scan starts */
+type eventState struct {
+	apiState
+	QueueLength int `json:"queue_length"`
+}
+
+/* eventPort is sent as a port event when an open port is found */
+type eventPort struct {
+	Port    int    `json:"port"`
+	Service string `json:"service,omitempty"`
+	Banner  string `json:"banner,omitempty"`
+}
+
+/* eventDone is sent as a done event when a scan finishes.  OpenPorts is
+nil if the scanned address may not see its results. */
+type eventDone struct {
+	ID        string    `json:"id"`
+	Addr      string    `json:"address"`
+	End       time.Time `json:"end"`
+	OpenPorts *int      `json:"open_ports,omitempty"`
+}
+
+/* Event subscribers, by address */
+var (
+	EVENTSUBS  = make(map[string]map[chan event]struct{})
+	EVENTSLOCK = &sync.Mutex{}
+)
+
+/* subscribe returns a channel on which a's events will be sent */
+func subscribe(a string) chan event {
+	ch := make(chan event, EVENTBUFFER)
+	EVENTSLOCK.Lock()
+	defer EVENTSLOCK.Unlock()
+	if _, ok := EVENTSUBS[a]; !ok {
+		EVENTSUBS[a] = make(map[chan event]struct{})
+	}
+	EVENTSUBS[a][ch] = struct{}{}
+	return ch
+}
+
+/* unsubscribe stops sending a's events to ch */
+func unsubscribe(a string, ch chan event) {
+	EVENTSLOCK.Lock()
+	defer EVENTSLOCK.Unlock()
+	delete(EVENTSUBS[a], ch)
+	if 0 == len(EVENTSUBS[a]) {
+		delete(EVENTSUBS, a)
+	}
+}
+
+/* publish sends an event to a's subscribers.  It never blocks; slow
+subscribers miss events. */
+func publish(a, name string, data interface{}) {
+	EVENTSLOCK.Lock()
+	defer EVENTSLOCK.Unlock()
+	for ch := range EVENTSUBS[a] {
+		select {
+		case ch <- event{name: name, data: data}:
+		default:
+			debug("%v Dropped %v event for slow client", a, name)
+		}
+	}
+}
+
+/* publishQueuePositions sends every queued address with subscribers its
+place in the queue.  The caller must hold QLOCK. */
+func publishQueuePositions() {
+	EVENTSLOCK.Lock()
+	n := len(EVENTSUBS)
+	EVENTSLOCK.Unlock()
+	if 0 == n {
+		return
+	}
+	pos := 1
+	for e := QUEUE.Front(); nil != e; e = e.Next() {
+		q := e.Value.(qaddr)
+		t := q.t
+		publish(q.a, "state", eventState{
+			apiState: apiState{
+				Addr:     q.a,
+				State:    STATEQUEUED,
+				Since:    &t,
+				Position: pos,
+			},
+			QueueLength: QUEUE.Len(),
+		})
+		pos++
+	}
+}
+
+/* writeEvent writes an event with the given name and JSON-encoded data to
+w */
+func writeEvent(w io.Writer, name string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if nil != err {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", name, b)
+	return err
+}
+
+/* events streams the requestor's queue position and scan progress as
+Server-Sent Events.  A state event with where things stand is sent first. */
+func events(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "Streaming not supported.")
+		return
+	}
+
+	/* Subscribe before getting the state, to not miss anything */
+	ch := subscribe(rip)
+	defer unsubscribe(rip, ch)
+	st, qlen := queueState(rip)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	if err := writeEvent(w, "state", eventState{
+		apiState:    st,
+		QueueLength: qlen,
+	}); nil != err {
+		return
+	}
+	fl.Flush()
+	debug("%v Streaming events", rip)
+
+	/* Send events as they happen */
+	t := time.NewTicker(EVENTKEEPALIVE)
+	defer t.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			debug("%v Event stream closed", rip)
+			return
+		case ev := <-ch:
+			err = writeEvent(w, ev.name, ev.data)
+		case <-t.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		}
+		if nil != err {
+			debug("%v Error sending event: %v", rip, err)
+			return
+		}
+		fl.Flush()
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+/*
+ * export.go
+ * Export and import results
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/* DBTIMEOUT is how long the export and import subcommands wait for a running
+cgiscan to release the database */
+const DBTIMEOUT = 5 * time.Second
+
+/* Export formats */
+const (
+	EXPORTJSONL   = "jsonl"
+	EXPORTNMAPXML = FORMATNMAPXML
+)
+
+/* EXPORTTYPES maps export formats to their Content-Types */
+var EXPORTTYPES = map[string]string{
+	EXPORTJSONL:   "application/x-ndjson",
+	EXPORTNMAPXML: FORMATTYPES[FORMATNMAPXML],
+}
+
+/* exportResults writes the results matched by f to w in the given format,
+either one JSON object per line or an nmap XML document.  It returns the
+number of results written. */
+func exportResults(w io.Writer, f resultFilter, format string) (int, error) {
+	/* Work out how to write each result */
+	var (
+		write  func(r *result) error
+		finish = func() error { return nil }
+	)
+	switch format {
+	case EXPORTJSONL:
+		enc := json.NewEncoder(w)
+		write = func(r *result) error { return enc.Encode(r) }
+	case EXPORTNMAPXML:
+		nw, err := newNmapWriter(w, time.Now())
+		if nil != err {
+			return 0, err
+		}
+		write = nw.Write
+		finish = func() error { return nw.Close(time.Now()) }
+	default:
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+
+	n := 0
+	if err := STORE.List(func(r *result) error {
+		if !f.match(r) {
+			return nil
+		}
+		if err := write(r); nil != err {
+			return err
+		}
+		n++
+		return nil
+	}); nil != err {
+		return n, err
+	}
+	return n, finish()
+}
+
+/* importResults reads JSON Lines results from r and stores them.  A result is
+only stored if it is newer than the stored result for its address, which
+makes importing the same results more than once harmless.  The number of
+results stored and skipped is returned. */
+func importResults(r io.Reader) (imported, skipped int, err error) {
+	dec := json.NewDecoder(r)
+	for {
+		/* Get the next result */
+		var res result
+		if err := dec.Decode(&res); io.EOF == err {
+			return imported, skipped, nil
+		} else if nil != err {
+			return imported, skipped, err
+		}
+		ip := net.ParseIP(res.Addr)
+		if nil == ip {
+			return imported, skipped, fmt.Errorf(
+				"invalid address %q",
+				res.Addr,
+			)
+		}
+		/* One key per address, however it's written */
+		res.Addr = ip.String()
+
+		/* Don't clobber newer results */
+		old, err := STORE.Get(res.Addr)
+		if nil != err {
+			return imported, skipped, err
+		}
+		if nil != old && !old.End.Before(res.End) {
+			skipped++
+			continue
+		}
+
+		if err := storeResult(&res, false); nil != err {
+			return imported, skipped, err
+		}
+		imported++
+	}
+}
+
+/* adminExport sends the results matching the net, since, and until query
+parameters as JSON Lines, or in the format given in the format query
+parameter */
+func adminExport(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	f, err := parseResultFilter(q.Get("net"), q.Get("since"), q.Get("until"))
+	if nil != err {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	format := q.Get("format")
+	if "" == format {
+		format = EXPORTJSONL
+	}
+	ct, ok := EXPORTTYPES[format]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, fmt.Sprintf("Unknown format %q", format))
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	n, err := exportResults(w, f, format)
+	if nil != err {
+		log.Printf("%v Error exporting results: %v", adminWho(req), err)
+		return
+	}
+	debug("%v Exported %v results", adminWho(req), n)
+}
+
+/* adminImport stores the JSON Lines results POSTed to it */
+func adminImport(w http.ResponseWriter, req *http.Request) {
+	if http.MethodPost != req.Method {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "Results must be POSTed.\n")
+		return
+	}
+	imported, skipped, err := importResults(req.Body)
+	if nil != err {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, fmt.Sprintf(
+			"Imported %v, skipped %v before error: %v\n",
+			imported,
+			skipped,
+			err,
+		))
+		debug("%v Import failed: %v", adminWho(req), err)
+		return
+	}
+	io.WriteString(w, fmt.Sprintf(
+		"Imported %v, skipped %v.\n",
+		imported,
+		skipped,
+	))
+	debug(
+		"%v Imported %v results, skipped %v",
+		adminWho(req),
+		imported,
+		skipped,
+	)
+}
+
+/* exportCmd implements the export subcommand */
+func exportCmd(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		dbFile = fs.String(
+			"db",
+			"/run/cgiscan/cgiscan.db",
+			"Database `file`",
+		)
+		storeKind = fs.String(
+			"store",
+			"bolt",
+			"Result storage `type`, one of "+
+				strings.Join(STORES, ", "),
+		)
+		adminPath = fs.String(
+			"admin",
+			"",
+			"Export via the admin socket at `path` instead of "+
+				"reading the database",
+		)
+		cidr = fs.String(
+			"net",
+			"",
+			"Only export results for addresses in `CIDR` range",
+		)
+		since = fs.String(
+			"since",
+			"",
+			"Only export results finished on or after `time` "+
+				"(RFC3339 or YYYY-MM-DD)",
+		)
+		until = fs.String(
+			"until",
+			"",
+			"Only export results finished on or before `time` "+
+				"(RFC3339 or YYYY-MM-DD)",
+		)
+		format = fs.String(
+			"format",
+			EXPORTJSONL,
+			"Export `format`, "+EXPORTJSONL+" or "+EXPORTNMAPXML,
+		)
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v export [options]
+
+Writes stored results to stdout as JSON Lines or, with -format nmapxml, as
+an nmap XML document.
+
+Options:
+`, os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if _, ok := EXPORTTYPES[*format]; !ok {
+		log.Fatalf("Unknown format %q", *format)
+	}
+
+	/* Via a running instance */
+	if "" != *adminPath {
+		q := url.Values{}
+		q.Set("format", *format)
+		q.Set("net", *cidr)
+		q.Set("since", *since)
+		q.Set("until", *until)
+		res, err := adminClient(*adminPath).Get(
+			"http://cgiscan/admin/export?" + q.Encode(),
+		)
+		if nil != err {
+			log.Fatalf("Unable to request export: %v", err)
+		}
+		defer res.Body.Close()
+		if http.StatusOK != res.StatusCode {
+			b, _ := io.ReadAll(res.Body)
+			log.Fatalf("Export failed (%v): %s", res.Status, b)
+		}
+		if _, err := io.Copy(os.Stdout, res.Body); nil != err {
+			log.Fatalf("Error receiving export: %v", err)
+		}
+		return
+	}
+
+	/* From the database directly */
+	f, err := parseResultFilter(*cidr, *since, *until)
+	if nil != err {
+		log.Fatalf("Invalid filter: %v", err)
+	}
+	if STORE, err = openStore(*storeKind, *dbFile, DBTIMEOUT); nil != err {
+		log.Fatalf("Unable to open database %v: %v", *dbFile, err)
+	}
+	defer STORE.Close()
+	if _, err := exportResults(os.Stdout, f, *format); nil != err {
+		log.Fatalf("Error exporting results: %v", err)
+	}
+}
+
+/* importCmd implements the import subcommand */
+func importCmd(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var (
+		dbFile = fs.String(
+			"db",
+			"/run/cgiscan/cgiscan.db",
+			"Database `file`",
+		)
+		storeKind = fs.String(
+			"store",
+			"bolt",
+			"Result storage `type`, one of "+
+				strings.Join(STORES, ", "),
+		)
+		adminPath = fs.String(
+			"admin",
+			"",
+			"Import via the admin socket at `path` instead of "+
+				"writing the database",
+		)
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v import [options] [file...]
+
+Reads JSON Lines results from the named files, or stdin if none are given,
+and stores any which are newer than the stored result for the same address.
+
+Options:
+`, os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	/* Work out where we're reading */
+	var in io.Reader = os.Stdin
+	if 0 != fs.NArg() {
+		rs := make([]io.Reader, 0, fs.NArg())
+		for _, fn := range fs.Args() {
+			f, err := os.Open(fn)
+			if nil != err {
+				log.Fatalf("Unable to open %v: %v", fn, err)
+			}
+			defer f.Close()
+			rs = append(rs, f)
+		}
+		in = io.MultiReader(rs...)
+	}
+
+	/* Via a running instance */
+	if "" != *adminPath {
+		res, err := adminClient(*adminPath).Post(
+			"http://cgiscan/admin/import",
+			"application/x-ndjson",
+			in,
+		)
+		if nil != err {
+			log.Fatalf("Unable to send import: %v", err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		if http.StatusOK != res.StatusCode {
+			log.Fatalf("Import failed (%v): %s", res.Status, b)
+		}
+		os.Stdout.Write(b)
+		return
+	}
+
+	/* Into the database directly */
+	var err error
+	if STORE, err = openStore(*storeKind, *dbFile, DBTIMEOUT); nil != err {
+		log.Fatalf("Unable to open database %v: %v", *dbFile, err)
+	}
+	defer STORE.Close()
+	imported, skipped, err := importResults(in)
+	if nil != err {
+		log.Fatalf(
+			"Error after importing %v and skipping %v: %v",
+			imported,
+			skipped,
+			err,
+		)
+	}
+	fmt.Printf("Imported %v, skipped %v.\n", imported, skipped)
+}
@@ -0,0 +1,335 @@
+package main
+
+/*
+ * format.go
+ * Output formats for results
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Output formats */
+const (
+	FORMATHTML     = "html"
+	FORMATTEXT     = "text"
+	FORMATJSON     = "json"
+	FORMATCSV      = "csv"
+	FORMATMARKDOWN = "markdown"
+	FORMATNMAPXML  = "nmapxml"
+)
+
+/* FORMATTYPES maps formats to their Content-Types */
+var FORMATTYPES = map[string]string{
+	FORMATHTML:     "text/html; charset=utf-8",
+	FORMATTEXT:     "text/plain; charset=utf-8",
+	FORMATJSON:     "application/json",
+	FORMATCSV:      "text/csv; charset=utf-8",
+	FORMATMARKDOWN: "text/markdown; charset=utf-8",
+	FORMATNMAPXML:  "application/xml",
+}
+
+/* FORMATALIASES are other names for formats which may be given in the format
+query parameter */
+var FORMATALIASES = map[string]string{
+	"htm":   FORMATHTML,
+	"txt":   FORMATTEXT,
+	"plain": FORMATTEXT,
+	"md":    FORMATMARKDOWN,
+	"xml":   FORMATNMAPXML,
+	"nmap":  FORMATNMAPXML,
+}
+
+/* MEDIAFORMATS maps media types in Accept headers to formats */
+var MEDIAFORMATS = map[string]string{
+	"text/html":             FORMATHTML,
+	"application/xhtml+xml": FORMATHTML,
+	"text/plain":            FORMATTEXT,
+	"application/json":      FORMATJSON,
+	"text/csv":              FORMATCSV,
+	"text/markdown":         FORMATMARKDOWN,
+	"text/x-markdown":       FORMATMARKDOWN,
+	"application/xml":       FORMATNMAPXML,
+	"text/xml":              FORMATNMAPXML,
+	"text/*":                FORMATTEXT,
+	"application/*":         FORMATJSON,
+	"*/*":                   FORMATTEXT,
+}
+
+/* negotiateFormat works out the format in which to respond to req, from the
+format query parameter or, failing that, the Accept header.  Browsers ask for
+HTML by name; clients which accept anything, like curl, get plain text.  The
+returned status is the HTTP status to send if there's an error. */
+func negotiateFormat(req *http.Request) (string, int, error) {
+	/* An explicit format wins */
+	if f := strings.ToLower(req.URL.Query().Get("format")); "" != f {
+		if a, ok := FORMATALIASES[f]; ok {
+			f = a
+		}
+		if _, ok := FORMATTYPES[f]; !ok {
+			return "", http.StatusBadRequest, fmt.Errorf(
+				"unknown format %q, must be one of %v",
+				f,
+				strings.Join(sortedFormats(), ", "),
+			)
+		}
+		return f, 0, nil
+	}
+
+	/* Failing that, look at what the client will accept */
+	accept := req.Header.Get("Accept")
+	if "" == accept {
+		return FORMATTEXT, 0, nil
+	}
+	var (
+		best     string
+		bestq    = -1.0
+		bestWild bool
+	)
+	for _, mr := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(mr))
+		if nil != err {
+			continue
+		}
+		f, ok := MEDIAFORMATS[mt]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); nil != err {
+				continue
+			}
+		}
+		/* More specific types win ties */
+		wild := strings.HasSuffix(mt, "*")
+		if q > bestq || (q == bestq && bestWild && !wild) {
+			best, bestq, bestWild = f, q, wild
+		}
+	}
+	if 0 >= bestq {
+		return "", http.StatusNotAcceptable, fmt.Errorf(
+			"none of %q are available",
+			accept,
+		)
+	}
+	return best, 0, nil
+}
+
+/* setFormatHeaders sets the headers for a response in format f */
+func setFormatHeaders(w http.ResponseWriter, f string) {
+	w.Header().Set("Content-Type", FORMATTYPES[f])
+	w.Header().Add("Vary", "Accept")
+}
+
+/* formatFail sends back an error message with the given HTTP status, as JSON
+if f is FORMATJSON or plain text otherwise */
+func formatFail(
+	w http.ResponseWriter,
+	f string,
+	status int,
+	format string,
+	a ...interface{},
+) {
+	if FORMATJSON == f {
+		apiFail(w, status, format, a...)
+		return
+	}
+	w.Header().Set("Content-Type", FORMATTYPES[FORMATTEXT])
+	w.WriteHeader(status)
+	io.WriteString(w, fmt.Sprintf(format, a...)+"\n")
+}
+
+/* writeResult writes r, and its annotation an, which may be nil, to w in
+format f, which must not be FORMATHTML */
+func writeResult(w io.Writer, f string, r *result, an *annotation) error {
+	switch f {
+	case FORMATTEXT:
+		_, err := w.Write(r.Report())
+		return err
+	case FORMATJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(apiResult{result: r, Annotation: an})
+	case FORMATCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(CSVHEADER)
+		writeResultCSV(cw, r)
+		cw.Flush()
+		return cw.Error()
+	case FORMATMARKDOWN:
+		return writeResultMarkdown(w, "#", r, an)
+	case FORMATNMAPXML:
+		return writeNmapXML(w, r)
+	default:
+		return fmt.Errorf("unable to write result as %v", f)
+	}
+}
+
+/* CSVHEADER is the header line for results in CSV */
+var CSVHEADER = []string{
+	"address",
+	"id",
+	"start",
+	"end",
+	"port",
+	"service",
+	"banner",
+}
+
+/* writeResultCSV writes a CSV line for each of r's open ports to cw.  If r
+has no open ports, a single line without a port is written. */
+func writeResultCSV(cw *csv.Writer, r *result) error {
+	line := []string{
+		r.Addr,
+		r.ID,
+		csvTime(r.Start),
+		csvTime(r.End),
+		"",
+		"",
+		"",
+	}
+	if 0 == len(r.Ports) {
+		return cw.Write(line)
+	}
+	for _, p := range r.Ports {
+		line[4] = strconv.Itoa(p.Port)
+		line[5] = csvText(reportService(p))
+		line[6] = csvText(string(p.Banner))
+		if err := cw.Write(line); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* csvText returns s, which came from a scanned host, with a ' prepended if
+it starts with something a spreadsheet would take as a formula */
+func csvText(s string) string {
+	if "" != s && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+/* csvTime formats t for CSV, or returns the empty string for the zero
+time */
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+/* writeResultMarkdown writes r and its annotation an, which may be nil, to w
+as Markdown, under a heading starting with h */
+func writeResultMarkdown(
+	w io.Writer,
+	h string,
+	r *result,
+	an *annotation,
+) error {
+	if _, err := fmt.Fprintf(
+		w,
+		"%v Scan Result for %v\n\n",
+		h,
+		r.Addr,
+	); nil != err {
+		return err
+	}
+
+	/* Annotations */
+	if nil != an {
+		if "" != an.Owner {
+			fmt.Fprintf(w, "* Owner: %v\n", mdEscape(an.Owner))
+		}
+		if 0 != len(an.Labels) {
+			ls := make([]string, len(an.Labels))
+			for i, l := range an.Labels {
+				ls[i] = mdEscape(l)
+			}
+			fmt.Fprintf(w, "* Labels: %v\n", strings.Join(ls, ", "))
+		}
+		if "" != an.Notes {
+			fmt.Fprintf(w, "* Notes: %v\n", mdEscape(an.Notes))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	/* Old results are just text */
+	if nil != r.Legacy {
+		_, err := fmt.Fprintf(w, "```\n%s\n```\n", r.Legacy)
+		return err
+	}
+
+	fmt.Fprintf(
+		w,
+		"Scan finished at %v\n\n",
+		r.End.UTC().Format(time.RFC3339),
+	)
+	if 0 == len(r.Ports) {
+		_, err := fmt.Fprintf(w, "No ports open.\n")
+		return err
+	}
+	fmt.Fprintf(w, "| Port | Service | Banner |\n")
+	fmt.Fprintf(w, "|-----:|---------|--------|\n")
+	for _, p := range r.Ports {
+		banner := "None"
+		if 0 != len(p.Banner) {
+			banner = "`" + strings.ReplaceAll(
+				quoteBanner(p.Banner),
+				"`",
+				"\\x60",
+			) + "`"
+		}
+		if _, err := fmt.Fprintf(
+			w,
+			"| %v | %v | %v |\n",
+			p.Port,
+			mdEscape(reportService(p)),
+			strings.ReplaceAll(banner, "|", "\\|"),
+		); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* MDESCAPER escapes characters with special meaning in Markdown */
+var MDESCAPER = strings.NewReplacer(
+	"\\", "\\\\",
+	"`", "\\`",
+	"*", "\\*",
+	"_", "\\_",
+	"[", "\\[",
+	"]", "\\]",
+	"<", "&lt;",
+	">", "&gt;",
+	"|", "\\|",
+	"\n", " ",
+)
+
+/* mdEscape escapes s for inclusion in Markdown */
+func mdEscape(s string) string { return MDESCAPER.Replace(s) }
+
+/* sortedFormats returns the names of the formats, sorted */
+func sortedFormats() []string {
+	fs := make([]string, 0, len(FORMATTYPES))
+	for f := range FORMATTYPES {
+		fs = append(fs, f)
+	}
+	sort.Strings(fs)
+	return fs
+}
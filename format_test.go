@@ -0,0 +1,83 @@
+package main
+
+/*
+ * format_test.go
+ * Make sure output formats are worked out and written safely
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, c := range []struct {
+		query  string
+		accept string
+		want   string
+		status int /* 0 if there's no error */
+	}{
+		{"", "", FORMATTEXT, 0},
+		{"", "*/*", FORMATTEXT, 0},
+		{"", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8",
+			FORMATHTML, 0},
+		{"", "application/json", FORMATJSON, 0},
+		{"", "application/*", FORMATJSON, 0},
+		{"", "text/csv;q=0.5, text/markdown", FORMATMARKDOWN, 0},
+		{"", "text/*, text/csv", FORMATCSV, 0},
+		{"", "text/plain;q=bad, application/json;q=0.1",
+			FORMATJSON, 0},
+		{"", "image/png", "", http.StatusNotAcceptable},
+		{"", "text/html;q=0", "", http.StatusNotAcceptable},
+		{"format=json", "text/html", FORMATJSON, 0},
+		{"format=MD", "", FORMATMARKDOWN, 0},
+		{"format=nmap", "", FORMATNMAPXML, 0},
+		{"format=pdf", "text/html", "", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(
+			http.MethodGet,
+			"/res/x?"+c.query,
+			nil,
+		)
+		if "" != c.accept {
+			req.Header.Set("Accept", c.accept)
+		}
+		got, status, err := negotiateFormat(req)
+		if got != c.want || status != c.status ||
+			(0 == c.status) != (nil == err) {
+			t.Errorf(
+				"%q with Accept %q: got %q, %v, %v; "+
+					"want %q, %v",
+				c.query,
+				c.accept,
+				got,
+				status,
+				err,
+				c.want,
+				c.status,
+			)
+		}
+	}
+}
+
+func TestCSVText(t *testing.T) {
+	for s, want := range map[string]string{
+		"":               "",
+		"SSH-2.0":        "SSH-2.0",
+		"=cmd|' /C calc": "'=cmd|' /C calc",
+		"+1":             "'+1",
+		"-1":             "'-1",
+		"@SUM(A1)":       "'@SUM(A1)",
+		"\tx":            "'\tx",
+		"\rx":            "'\rx",
+		"a=b":            "a=b",
+	} {
+		if got := csvText(s); got != want {
+			t.Errorf("csvText(%q): got %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+/*
+ * health.go
+ * Health and readiness checks
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* HEALTHBUCKET holds the value written and read back to check the database */
+const HEALTHBUCKET = "Health"
+
+/* DBCHECKCACHE is how long the outcome of writing to the database is reused,
+so frequent checks don't turn into frequent writes */
+const DBCHECKCACHE = 5 * time.Second
+
+/* SCANNERSTALL is how long the scanner may go without making progress before
+it's unhealthy, settable with -stall */
+var SCANNERSTALL = 5 * time.Minute
+
+/* Scanner progress, updated atomically */
+var (
+	SCANNERBEAT int64 /* Last progress, in Unix nanoseconds */
+	SCANNERIDLE int32 /* 1 if waiting for something to scan */
+)
+
+/* Outcome of the last attempt to save a result */
+var (
+	LASTSAVEERR  error
+	LASTSAVELOCK = &sync.Mutex{}
+)
+
+/* Outcome of the last write to check the database */
+var (
+	DBCHECKED   time.Time
+	DBCHECKERR  error
+	DBCHECKLOCK = &sync.Mutex{}
+)
+
+/* Listeners which should be up, by name, with their addresses once they are */
+var (
+	LISTENERS     = make(map[string]net.Addr)
+	LISTENERSLOCK = &sync.Mutex{}
+)
+
+/* scannerBeat notes the scanner's made progress, and whether it's now idle */
+func scannerBeat(idle bool) {
+	atomic.StoreInt64(&SCANNERBEAT, time.Now().UnixNano())
+	var i int32
+	if idle {
+		i = 1
+	}
+	atomic.StoreInt32(&SCANNERIDLE, i)
+}
+
+/* noteSave notes the outcome of saving a result */
+func noteSave(err error) {
+	LASTSAVELOCK.Lock()
+	defer LASTSAVELOCK.Unlock()
+	LASTSAVEERR = err
+}
+
+/* expectListener notes a listener named n should come up */
+func expectListener(n string) {
+	LISTENERSLOCK.Lock()
+	defer LISTENERSLOCK.Unlock()
+	LISTENERS[n] = nil
+}
+
+/* listenerUp notes the listener named n is up on l */
+func listenerUp(n string, l net.Listener) {
+	LISTENERSLOCK.Lock()
+	defer LISTENERSLOCK.Unlock()
+	LISTENERS[n] = l.Addr()
+}
+
+/* checkDatabase makes sure the database can be written and read.  The
+database is only written if it's not been checked in the last
+DBCHECKCACHE. */
+func checkDatabase() (string, error) {
+	DBCHECKLOCK.Lock()
+	if DBCHECKCACHE <= time.Since(DBCHECKED) {
+		DBCHECKERR = writeCheck()
+		DBCHECKED = time.Now()
+	}
+	err := DBCHECKERR
+	DBCHECKLOCK.Unlock()
+	if nil != err {
+		return "", err
+	}
+
+	/* Writes elsewhere may still fail */
+	LASTSAVELOCK.Lock()
+	defer LASTSAVELOCK.Unlock()
+	if nil != LASTSAVEERR {
+		return "", fmt.Errorf("saving last result: %v", LASTSAVEERR)
+	}
+	return "read and written", nil
+}
+
+/* writeCheck writes a value to the database and makes sure it reads back */
+func writeCheck() error {
+	want := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := STORE.PutKV(HEALTHBUCKET, "check", want); nil != err {
+		return fmt.Errorf("write: %v", err)
+	}
+	got, err := STORE.GetKV(HEALTHBUCKET, "check")
+	if nil != err {
+		return fmt.Errorf("read: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		return fmt.Errorf("read back %q, wrote %q", got, want)
+	}
+	return nil
+}
+
+/* checkScanner makes sure the scanner's made progress recently enough */
+func checkScanner() (string, error) {
+	if 1 == atomic.LoadInt32(&SCANNERIDLE) {
+		return "idle", nil
+	}
+	bn := atomic.LoadInt64(&SCANNERBEAT)
+	if 0 == bn {
+		return "", fmt.Errorf("not started")
+	}
+	since := time.Since(time.Unix(0, bn)).Round(time.Millisecond)
+	if SCANNERSTALL < since {
+		return "", fmt.Errorf("no progress for %v", since)
+	}
+	return fmt.Sprintf("progress %v ago", since), nil
+}
+
+/* checkListener makes sure a listener, with the address a once it's up, is
+up.  Unix sockets also have to still exist.  As anybody may ask, the returned
+error doesn't say where the listener is; the reason it failed is logged. */
+func checkListener(n string, a net.Addr) (string, error) {
+	var err error
+	if nil == a {
+		err = fmt.Errorf("not listening")
+	} else if "unix" == a.Network() {
+		var fi os.FileInfo
+		if fi, err = os.Stat(a.String()); nil == err &&
+			0 == fi.Mode()&os.ModeSocket {
+			err = fmt.Errorf("%v is not a socket", a)
+		}
+	}
+	if nil != err {
+		log.Printf("Listener %v failed health check: %v", n, err)
+		return "", fmt.Errorf("failed")
+	}
+	return "listening", nil
+}
+
+/* healthCheck is the outcome of a single check */
+type healthCheck struct {
+	name string
+	msg  string
+	err  error
+}
+
+/* runHealthChecks checks the database and scanner, and the listeners if
+listeners is true */
+func runHealthChecks(listeners bool) []healthCheck {
+	var hcs []healthCheck
+	msg, err := checkDatabase()
+	hcs = append(hcs, healthCheck{"database", msg, err})
+	msg, err = checkScanner()
+	hcs = append(hcs, healthCheck{"scanner", msg, err})
+	if !listeners {
+		return hcs
+	}
+
+	/* Listeners, in a stable order */
+	LISTENERSLOCK.Lock()
+	ns := make([]string, 0, len(LISTENERS))
+	for n := range LISTENERS {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	for _, n := range ns {
+		msg, err := checkListener(n, LISTENERS[n])
+		hcs = append(hcs, healthCheck{"listener " + n, msg, err})
+	}
+	LISTENERSLOCK.Unlock()
+	return hcs
+}
+
+/* sendHealth runs the checks and sends back the outcome of each, with a 200
+if they all passed or a 503 if not */
+func sendHealth(w http.ResponseWriter, req *http.Request, listeners bool) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Check everything */
+	var (
+		b      bytes.Buffer
+		failed int
+	)
+	for _, hc := range runHealthChecks(listeners) {
+		if nil != hc.err {
+			failed++
+			fmt.Fprintf(&b, "FAIL %v: %v\n", hc.name, hc.err)
+		} else {
+			fmt.Fprintf(&b, "ok   %v: %v\n", hc.name, hc.msg)
+		}
+	}
+
+	/* Tell the requestor */
+	w.Header().Set("Content-Type", FORMATTYPES[FORMATTEXT])
+	w.Header().Set("Cache-Control", "no-store")
+	if 0 != failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	b.WriteTo(w)
+	debug("%v Sent %v (%v failed)", rip, req.URL.Path, failed)
+}
+
+/* healthz checks the database and scanner */
+func healthz(w http.ResponseWriter, req *http.Request) {
+	sendHealth(w, req, false)
+}
+
+/* readyz checks the database, scanner, and listeners */
+func readyz(w http.ResponseWriter, req *http.Request) {
+	sendHealth(w, req, true)
+}
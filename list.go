@@ -5,20 +5,532 @@ package main
  * List scanned hosts
  * By J. Stuart McMurray
  * Created 20160706
- * Last Modified 20160706
+ * Last Modified 20261018
  */
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Number of addresses on a page of the list, by default and at most */
+const (
+	LISTPAGESIZE = 100
+	LISTMAXPAGE  = 1000
+)
 
-	"github.com/boltdb/bolt"
+/* Orders in which the list may be sorted */
+const (
+	LISTSORTADDR  = "address"
+	LISTSORTDATE  = "date"
+	LISTSORTPORTS = "ports"
 )
 
-/* List returns the list of scanned hosts */
+/* LISTORDERBUCKET keeps every listable address in each of the list's orders,
+so a page can start at its cursor.  Its keys are
+
+address/<key>                The address
+date/<finish time>/<key>     The address
+ports/<open ports>/<key>     The address
+keys/<address>               The address' other keys, as JSON
+mode                         The LISTADDRS used to make the keys
+
+where <key> is the address' listKey in hex, finish times are UTC and formatted
+with LISTORDERTIME, and open port counts are zero-padded to five digits.  If
+the mode isn't the current LISTADDRS, the bucket is rebuilt. */
+const LISTORDERBUCKET = "ListOrder"
+
+/* LISTORDERTIME formats finish times in LISTORDERBUCKET's keys so they sort
+in time order */
+const LISTORDERTIME = "20060102150405.000000000"
+
+/* LISTORDERLOCK keeps updates to LISTORDERBUCKET from interleaving */
+var LISTORDERLOCK = &sync.Mutex{}
+
+/* listQuery selects, orders, and pages through the scanned hosts */
+type listQuery struct {
+	filter   resultFilter
+	label    string
+	minPorts int /* -1 for no minimum */
+	maxPorts int /* -1 for no maximum */
+	sort     string
+	desc     bool
+	n        int       /* Page size */
+	after    *listHost /* Cursor, nil for the first page */
+}
+
+/* parseListQuery makes a listQuery from the query parameters in q */
+func parseListQuery(q url.Values) (listQuery, error) {
+	lq := listQuery{
+		label:    q.Get("label"),
+		minPorts: -1,
+		maxPorts: -1,
+		sort:     LISTSORTADDR,
+		n:        LISTPAGESIZE,
+	}
+	var err error
+
+	/* Filters */
+	if lq.filter, err = parseResultFilter(
+		q.Get("net"),
+		q.Get("since"),
+		q.Get("until"),
+	); nil != err {
+		return lq, err
+	}
+	if err := checkListNet(lq.filter.net); nil != err {
+		return lq, err
+	}
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"min_ports", &lq.minPorts}, {"max_ports", &lq.maxPorts}} {
+		s := q.Get(p.name)
+		if "" == s {
+			continue
+		}
+		if *p.n, err = strconv.Atoi(s); nil != err || 0 > *p.n {
+			return lq, fmt.Errorf("invalid %v %q", p.name, s)
+		}
+	}
+
+	/* Order.  Dates and port counts are most useful biggest first. */
+	switch s := q.Get("sort"); s {
+	case "", LISTSORTADDR:
+	case LISTSORTDATE, LISTSORTPORTS:
+		lq.sort = s
+		lq.desc = true
+	default:
+		return lq, fmt.Errorf(
+			"sort must be %q, %q, or %q",
+			LISTSORTADDR,
+			LISTSORTDATE,
+			LISTSORTPORTS,
+		)
+	}
+	switch o := q.Get("order"); o {
+	case "":
+	case "asc":
+		lq.desc = false
+	case "desc":
+		lq.desc = true
+	default:
+		return lq, fmt.Errorf("order must be \"asc\" or \"desc\"")
+	}
+
+	/* Page */
+	if s := q.Get("n"); "" != s {
+		lq.n, err = strconv.Atoi(s)
+		if nil != err || 1 > lq.n || LISTMAXPAGE < lq.n {
+			return lq, fmt.Errorf(
+				"n must be between 1 and %v",
+				LISTMAXPAGE,
+			)
+		}
+	}
+	if s := q.Get("after"); "" != s {
+		if lq.after, err = lq.parseCursor(s); nil != err {
+			return lq, err
+		}
+	}
+
+	return lq, nil
+}
+
+/* cursor returns the cursor for the page after h.  If listed addresses are
+hidden, the cursor has h's key instead of its address. */
+func (lq listQuery) cursor(h *listHost) string {
+	a := h.Addr
+	if hiddenAddrs() {
+		a = hex.EncodeToString(h.key)
+	}
+	switch lq.sort {
+	case LISTSORTDATE:
+		return h.End.UTC().Format(time.RFC3339Nano) + "_" + a
+	case LISTSORTPORTS:
+		return strconv.Itoa(h.OpenPorts) + "_" + a
+	default:
+		return a
+	}
+}
+
+/* parseCursor turns a cursor made by cursor back into a listHost */
+func (lq listQuery) parseCursor(s string) (*listHost, error) {
+	bad := fmt.Errorf("invalid cursor %q for sort %v", s, lq.sort)
+	h := &listHost{Addr: s}
+	if LISTSORTADDR != lq.sort {
+		i := strings.LastIndex(s, "_")
+		if -1 == i {
+			return nil, bad
+		}
+		h.Addr = s[i+1:]
+		var err error
+		switch lq.sort {
+		case LISTSORTDATE:
+			h.End, err = time.Parse(time.RFC3339Nano, s[:i])
+		case LISTSORTPORTS:
+			h.OpenPorts, err = strconv.Atoi(s[:i])
+		}
+		if nil != err {
+			return nil, bad
+		}
+	}
+	if hiddenAddrs() {
+		var err error
+		if h.key, err = hex.DecodeString(h.Addr); nil != err ||
+			0 == len(h.key) {
+			return nil, bad
+		}
+		h.Addr = ""
+	} else if h.key = addrKey(h.Addr); nil == h.key {
+		return nil, bad
+	}
+	return h, nil
+}
+
+/* less returns true if a comes before b.  Ties are broken by key, which is
+unique, so every host has a place for the cursor to mark. */
+func (lq listQuery) less(a, b *listHost) bool {
+	c := 0
+	switch lq.sort {
+	case LISTSORTDATE:
+		if a.End.Before(b.End) {
+			c = -1
+		} else if a.End.After(b.End) {
+			c = 1
+		}
+	case LISTSORTPORTS:
+		c = a.OpenPorts - b.OpenPorts
+	}
+	if 0 == c {
+		c = bytes.Compare(a.key, b.key)
+	}
+	if lq.desc {
+		return 0 < c
+	}
+	return 0 > c
+}
+
+/* match returns true if the host h, whose result is r, should be listed.
+Hosts before the cursor are not listed. */
+func (lq listQuery) match(r *result, h *listHost) bool {
+	if !lq.filter.match(r) {
+		return false
+	}
+	if "" != lq.label && (nil == h.Annotation ||
+		!h.Annotation.hasLabel(lq.label)) {
+		return false
+	}
+	if -1 != lq.minPorts && h.OpenPorts < lq.minPorts {
+		return false
+	}
+	if -1 != lq.maxPorts && h.OpenPorts > lq.maxPorts {
+		return false
+	}
+	if nil != lq.after && !lq.less(lq.after, h) {
+		return false
+	}
+	return true
+}
+
+/* orderKey returns h's key in LISTORDERBUCKET for the order o */
+func orderKey(o string, h *listHost) string {
+	k := hex.EncodeToString(h.key)
+	switch o {
+	case LISTSORTDATE:
+		return o + "/" + h.End.UTC().Format(LISTORDERTIME) + "/" + k
+	case LISTSORTPORTS:
+		return fmt.Sprintf("%v/%05d/%v", o, h.OpenPorts, k)
+	default:
+		return LISTSORTADDR + "/" + k
+	}
+}
+
+/* saveListOrder replaces r's address' keys in LISTORDERBUCKET with r's.  It
+does nothing if the bucket is to be rebuilt. */
+func saveListOrder(r *result) error {
+	LISTORDERLOCK.Lock()
+	defer LISTORDERLOCK.Unlock()
+	if ok, err := listOrderCurrent(); nil != err || !ok {
+		return err
+	}
+	if err := unorderAddr(r.Addr); nil != err {
+		return err
+	}
+	return orderResult(r)
+}
+
+/* removeListOrder removes a's keys from LISTORDERBUCKET */
+func removeListOrder(a string) error {
+	LISTORDERLOCK.Lock()
+	defer LISTORDERLOCK.Unlock()
+	if ok, err := listOrderCurrent(); nil != err || !ok {
+		return err
+	}
+	return unorderAddr(a)
+}
+
+/* listOrderCurrent returns true if LISTORDERBUCKET's keys were made with the
+current LISTADDRS.  If not, it makes sure the bucket will be rebuilt, as
+something else, such as an import, has changed results without it.  The
+caller must hold LISTORDERLOCK. */
+func listOrderCurrent() (bool, error) {
+	m, err := STORE.GetKV(LISTORDERBUCKET, "mode")
+	if nil != err || nil == m {
+		return false, err
+	}
+	if LISTADDRS == string(m) {
+		return true, nil
+	}
+	return false, STORE.DeleteKV(LISTORDERBUCKET, "mode")
+}
+
+/* unorderAddr removes a's keys from LISTORDERBUCKET.  The caller must hold
+LISTORDERLOCK. */
+func unorderAddr(a string) error {
+	v, err := STORE.GetKV(LISTORDERBUCKET, "keys/"+a)
+	if nil != err || nil == v {
+		return err
+	}
+	var ks []string
+	if err := json.Unmarshal(v, &ks); nil != err {
+		return fmt.Errorf("decoding list keys for %v: %v", a, err)
+	}
+	for _, k := range append(ks, "keys/"+a) {
+		if err := STORE.DeleteKV(LISTORDERBUCKET, k); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* orderResult adds r's address to LISTORDERBUCKET, if it can be listed.  The
+caller must hold LISTORDERLOCK. */
+func orderResult(r *result) error {
+	h := &listHost{
+		End:       r.End,
+		OpenPorts: len(r.Ports),
+		key:       listKey(r.Addr),
+	}
+	if nil == h.key {
+		return nil
+	}
+	var ks []string
+	for _, o := range []string{LISTSORTADDR, LISTSORTDATE, LISTSORTPORTS} {
+		k := orderKey(o, h)
+		if err := STORE.PutKV(
+			LISTORDERBUCKET,
+			k,
+			[]byte(r.Addr),
+		); nil != err {
+			return err
+		}
+		ks = append(ks, k)
+	}
+	v, err := json.Marshal(ks)
+	if nil != err {
+		return err
+	}
+	return STORE.PutKV(LISTORDERBUCKET, "keys/"+r.Addr, v)
+}
+
+/* fillListOrder rebuilds LISTORDERBUCKET if it wasn't made with the current
+LISTADDRS.  If addresses are hidden, the address hash key must be loaded. */
+func fillListOrder() error {
+	LISTORDERLOCK.Lock()
+	defer LISTORDERLOCK.Unlock()
+	if ok, err := listOrderCurrent(); nil != err || ok {
+		return err
+	}
+
+	/* Clear out the old keys */
+	var ks []string
+	if err := STORE.ForEachKV(
+		LISTORDERBUCKET,
+		func(k string, v []byte) error {
+			ks = append(ks, k)
+			return nil
+		},
+	); nil != err {
+		return err
+	}
+	for _, k := range ks {
+		if err := STORE.DeleteKV(LISTORDERBUCKET, k); nil != err {
+			return err
+		}
+	}
+
+	/* Add every result */
+	var rs []*result
+	if err := STORE.List(func(r *result) error {
+		rs = append(rs, r)
+		return nil
+	}); nil != err {
+		return err
+	}
+	for _, r := range rs {
+		if err := orderResult(r); nil != err {
+			return err
+		}
+	}
+	if 0 != len(rs) {
+		log.Printf("Put %v addresses in list order", len(rs))
+	}
+	return STORE.PutKV(LISTORDERBUCKET, "mode", []byte(LISTADDRS))
+}
+
+/* forEachListed calls f with the addresses in LISTORDERBUCKET in the order o,
+starting after the key from, or at the start if from is the empty string, until
+f returns false or an error.  Addresses are read n at a time, as f may use
+STORE. */
+func forEachListed(
+	o string,
+	desc bool,
+	from string,
+	n int,
+	f func(a string) (bool, error),
+) error {
+	prefix := o + "/"
+	if "" == from {
+		from = prefix
+		if desc {
+			from += "\x7f"
+		}
+	}
+	for {
+		/* Get the next few addresses */
+		var as []string
+		if err := STORE.ForEachKVFrom(
+			LISTORDERBUCKET,
+			from,
+			desc,
+			func(k string, v []byte) error {
+				if k == from {
+					return nil
+				}
+				if !strings.HasPrefix(k, prefix) ||
+					n <= len(as) {
+					return ERRSTOPWALK
+				}
+				as = append(as, string(v))
+				from = k
+				return nil
+			},
+		); nil != err {
+			return err
+		}
+
+		/* Hand them to f */
+		for _, a := range as {
+			if more, err := f(a); nil != err || !more {
+				return err
+			}
+		}
+		if n > len(as) {
+			return nil
+		}
+	}
+}
+
+/* addrKey returns a key for the address a which sorts IPv4 addresses
+numerically, followed by IPv6 addresses.  It returns nil if a isn't an IP
+address. */
+func addrKey(a string) []byte {
+	ip := net.ParseIP(a)
+	if nil == ip {
+		return nil
+	}
+	if ip4 := ip.To4(); nil != ip4 {
+		return append([]byte{4}, ip4...)
+	}
+	return append([]byte{6}, ip.To16()...)
+}
+
+/* listHosts returns a page of hosts selected by lq which may be listed to the
+requestor at rip, and whether there's another page.  Hosts are read in order
+from LISTORDERBUCKET, starting at the cursor, until there's a page of them
+which match, so filters which match few hosts read more of them. */
+func listHosts(lq listQuery, rip string) ([]*listHost, bool, error) {
+	if err := fillListOrder(); nil != err {
+		return nil, false, err
+	}
+
+	/* Keep one more than a page, to know if there's another page */
+	var (
+		hs   []*listHost
+		from string
+		err  error
+	)
+	if nil != lq.after {
+		from = orderKey(lq.sort, lq.after)
+	}
+	if err := forEachListed(
+		lq.sort,
+		lq.desc,
+		from,
+		lq.n+1,
+		func(a string) (bool, error) {
+			r, err := STORE.Get(a)
+			if nil != err || nil == r {
+				return true, err
+			}
+			lh := &listHost{
+				Addr:      r.Addr,
+				End:       r.End,
+				OpenPorts: len(r.Ports),
+				key:       listKey(r.Addr),
+			}
+			if "" != lq.label && canSeeAnnotation(rip, r.Addr) {
+				if lh.Annotation, err = getAnnotation(
+					r.Addr,
+				); nil != err {
+					return false, err
+				}
+			}
+			if nil == lh.key || !listable(rip, r.Addr) ||
+				!lq.match(r, lh) {
+				return true, nil
+			}
+			hs = append(hs, lh)
+			return lq.n+1 > len(hs), nil
+		},
+	); nil != err {
+		return nil, false, err
+	}
+
+	/* Trim to a page */
+	more := len(hs) > lq.n
+	if more {
+		hs = hs[:lq.n]
+	}
+
+	/* Work out how they're shown, with the page's annotations */
+	for _, lh := range hs {
+		lh.Shown, lh.Link = shownAddr(rip, lh.Addr)
+		if "" == lq.label && canSeeAnnotation(rip, lh.Addr) {
+			if lh.Annotation, err = getAnnotation(
+				lh.Addr,
+			); nil != err {
+				return nil, false, err
+			}
+		}
+	}
+	return hs, more, nil
+}
+
+/* List returns a page of the list of scanned hosts, with their annotations.
+Query parameters select which hosts are listed and in what order. */
 func listScanned(w http.ResponseWriter, req *http.Request) {
 	/* Get the requestor's address */
 	rip, _, err := net.SplitHostPort(req.RemoteAddr)
@@ -28,66 +540,74 @@ func listScanned(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	/* List of IP Addresses */
-	ips := make([]string, 0)
+	/* Work out what to list */
+	q := req.URL.Query()
+	page := listPage{
+		Label:    q.Get("label"),
+		Net:      q.Get("net"),
+		Since:    q.Get("since"),
+		Until:    q.Get("until"),
+		MinPorts: q.Get("min_ports"),
+		MaxPorts: q.Get("max_ports"),
+		Sort:     q.Get("sort"),
+		Order:    q.Get("order"),
+		Paged:    "" != q.Get("after"),
+	}
+	lq, err := parseListQuery(q)
+	if nil != err {
+		w.WriteHeader(http.StatusBadRequest)
+		page.Error = err.Error()
+		renderPage(w, "list.html", page)
+		return
+	}
 
-	/* Get the list of addresses */
-	if err := DB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(RESBUCKET))
-		/* Iterate over all the keys */
-		c := bucket.Cursor()
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			/* []byte -> String -> []byte -> string */
-			ip := net.ParseIP(string(k))
-			if ip4 := ip.To4(); nil != ip4 {
-				ip = ip4
-			}
-			ips = append(ips, string(ip))
-		}
-		return nil
-	}); nil != err {
+	/* Get a page of them */
+	hs, more, err := listHosts(lq, rip)
+	if nil != err {
 		w.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(w, err.Error())
 		return
 	}
-
-	/* Sort list of IPs */
-	sort.Strings(ips)
+	page.Hosts = hs
+	if more {
+		q.Set("after", lq.cursor(hs[len(hs)-1]))
+		page.Next = URLPATH + "/list?" + q.Encode()
+	}
+	q.Del("after")
+	page.First = URLPATH + "/list?" + q.Encode()
 
 	/* Return them */
-	if _, err := io.WriteString(
-		w,
-		`<!DOCTYPE HTML>
-<HEAD>
-	<TITLE>CGIScanned</TITLE>
-	<STYLE TYPE="text/css"><!--
-		body {
-			background-color: white;
-			color: black;
-			font-family: 'Comic Sans MS', 'Chalkboard SE', 'Comic Neue', sans-serif;
-		}
-	--></STYLE>
-</HEAD>
-<BODY>
-<H1>Scanned IP Addresses</H1>
-<P>
-`); nil != err {
+	if err := renderPage(w, "list.html", page); nil != err {
 		return
 	}
-	for _, ip := range ips {
-		a := net.IP(ip).String()
-		if _, err := w.Write([]byte(fmt.Sprintf(
-			"<A HREF=\"%v/res/%v\">%v</A><BR>\n",
-			URLPATH,
-			a,
-			a,
-		))); nil != err {
-			return
-		}
-	}
-	io.WriteString(w, "</P>\n</BODY>\n</HTML>\n")
 
-	debug("%v Sent list of %v address links", rip, len(ips))
+	debug("%v Sent list of %v address links", rip, len(hs))
+}
+
+/* listPage is what's needed to render the list of scanned hosts */
+type listPage struct {
+	Label    string
+	Net      string
+	Since    string
+	Until    string
+	MinPorts string
+	MaxPorts string
+	Sort     string
+	Order    string
+	Error    string
+	Hosts    []*listHost
+	Paged    bool   /* Not the first page */
+	First    string /* URL of the first page */
+	Next     string /* URL of the next page, if there is one */
 }
 
-/* TODO: Templates? :( */
+/* listHost is a scanned host and its annotation, which may be nil */
+type listHost struct {
+	Addr       string
+	Shown      string /* Addr, as the requestor may see it */
+	Link       bool   /* Requestor may see Addr's results */
+	End        time.Time
+	OpenPorts  int
+	Annotation *annotation
+	key        []byte /* From listKey */
+}
@@ -0,0 +1,108 @@
+package main
+
+/*
+ * list_test.go
+ * Make sure list cursors find their way back
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestListCursor(t *testing.T) {
+	defer func(l string, k []byte) {
+		LISTADDRS, ADDRHASHKEY = l, k
+	}(LISTADDRS, ADDRHASHKEY)
+	ADDRHASHKEY = []byte("test key")
+
+	for _, mode := range []string{
+		ADDRSFULL,
+		ADDRSTRUNCATED,
+		ADDRSHASHED,
+	} {
+		LISTADDRS = mode
+		for _, sort := range []string{
+			LISTSORTADDR,
+			LISTSORTDATE,
+			LISTSORTPORTS,
+		} {
+			for _, a := range []string{"192.0.2.1", "2001:db8::1"} {
+				lq, err := parseListQuery(url.Values{
+					"sort": {sort},
+				})
+				if nil != err {
+					t.Fatalf("parseListQuery: %v", err)
+				}
+				h := &listHost{
+					Addr: a,
+					End: time.Date(
+						2026, 10, 18, 1, 2, 3, 4,
+						time.UTC,
+					),
+					OpenPorts: 3,
+					key:       listKey(a),
+				}
+				c := lq.cursor(h)
+				got, err := lq.parseCursor(c)
+				if nil != err {
+					t.Fatalf(
+						"%v %v %v: cursor %q: %v",
+						mode,
+						sort,
+						a,
+						c,
+						err,
+					)
+				}
+				if ok, gk := orderKey(sort, h),
+					orderKey(sort, got); !bytes.Equal(
+					got.key,
+					h.key,
+				) || ok != gk {
+					t.Errorf(
+						"%v %v %v: cursor %q "+
+							"came back as %+v",
+						mode,
+						sort,
+						a,
+						c,
+						got,
+					)
+				}
+				if hiddenAddrs() && bytes.Contains(
+					[]byte(c),
+					[]byte(a),
+				) {
+					t.Errorf(
+						"%v %v: cursor %q has %v",
+						mode,
+						sort,
+						c,
+						a,
+					)
+				}
+			}
+		}
+	}
+
+	/* Rubbish cursors are refused */
+	LISTADDRS = ADDRSFULL
+	for sort, cs := range map[string][]string{
+		LISTSORTADDR:  {"x", "999.0.0.1"},
+		LISTSORTDATE:  {"192.0.2.1", "yesterday_192.0.2.1"},
+		LISTSORTPORTS: {"3", "three_192.0.2.1", "3_x"},
+	} {
+		lq := listQuery{sort: sort}
+		for _, c := range cs {
+			if _, err := lq.parseCursor(c); nil == err {
+				t.Errorf("%v cursor %q accepted", sort, c)
+			}
+		}
+	}
+}
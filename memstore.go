@@ -0,0 +1,215 @@
+package main
+
+/*
+ * memstore.go
+ * Store results in memory
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"sort"
+	"sync"
+)
+
+/* memStore is a Store which keeps everything in memory, for testing and
+ephemeral instances.  Results are kept encoded so that callers can't modify
+stored results. */
+type memStore struct {
+	l      *sync.Mutex
+	latest map[string][]byte            /* Address -> result */
+	hist   map[string]map[string][]byte /* Address -> ID -> result */
+	kv     map[string]map[string][]byte /* Bucket -> key -> value */
+}
+
+/* newMemStore returns a new, empty, memStore */
+func newMemStore() *memStore {
+	return &memStore{
+		l:      &sync.Mutex{},
+		latest: make(map[string][]byte),
+		hist:   make(map[string]map[string][]byte),
+		kv:     make(map[string]map[string][]byte),
+	}
+}
+
+/* Save implements Store.Save */
+func (s *memStore) Save(r *result) error {
+	r.setID()
+	v, err := encodeResult(r)
+	if nil != err {
+		return err
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.latest[r.Addr] = v
+	if _, ok := s.hist[r.Addr]; !ok {
+		s.hist[r.Addr] = make(map[string][]byte)
+	}
+	s.hist[r.Addr][r.ID] = v
+	return nil
+}
+
+/* Get implements Store.Get */
+func (s *memStore) Get(a string) (*result, error) {
+	s.l.Lock()
+	v, ok := s.latest[a]
+	s.l.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return decodeResult(a, v)
+}
+
+/* List implements Store.List */
+func (s *memStore) List(f func(r *result) error) error {
+	/* Snapshot the results, to keep the locking short */
+	s.l.Lock()
+	as := make([]string, 0, len(s.latest))
+	vs := make(map[string][]byte, len(s.latest))
+	for a, v := range s.latest {
+		as = append(as, a)
+		vs[a] = v
+	}
+	s.l.Unlock()
+	sort.Strings(as)
+
+	for _, a := range as {
+		r, err := decodeResult(a, vs[a])
+		if nil != err {
+			return err
+		}
+		if err := f(r); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Delete implements Store.Delete */
+func (s *memStore) Delete(a string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	delete(s.latest, a)
+	delete(s.hist, a)
+	return nil
+}
+
+/* History implements Store.History */
+func (s *memStore) History(a string) ([]*result, error) {
+	s.l.Lock()
+	ids := make([]string, 0, len(s.hist[a]))
+	vs := make([][]byte, 0, len(s.hist[a]))
+	for id := range s.hist[a] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		vs = append(vs, s.hist[a][id])
+	}
+	s.l.Unlock()
+
+	rs := make([]*result, 0, len(vs))
+	for _, v := range vs {
+		r, err := decodeResult(a, v)
+		if nil != err {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+/* PutKV implements Store.PutKV */
+func (s *memStore) PutKV(bucket, k string, v []byte) error {
+	c := make([]byte, len(v))
+	copy(c, v)
+	s.l.Lock()
+	defer s.l.Unlock()
+	if _, ok := s.kv[bucket]; !ok {
+		s.kv[bucket] = make(map[string][]byte)
+	}
+	s.kv[bucket][k] = c
+	return nil
+}
+
+/* GetKV implements Store.GetKV */
+func (s *memStore) GetKV(bucket, k string) ([]byte, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	v, ok := s.kv[bucket][k]
+	if !ok {
+		return nil, nil
+	}
+	c := make([]byte, len(v))
+	copy(c, v)
+	return c, nil
+}
+
+/* DeleteKV implements Store.DeleteKV */
+func (s *memStore) DeleteKV(bucket, k string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	delete(s.kv[bucket], k)
+	return nil
+}
+
+/* ForEachKV implements Store.ForEachKV */
+func (s *memStore) ForEachKV(
+	bucket string,
+	f func(k string, v []byte) error,
+) error {
+	/* Snapshot the bucket, to keep the locking short */
+	s.l.Lock()
+	ks := make([]string, 0, len(s.kv[bucket]))
+	vs := make(map[string][]byte, len(s.kv[bucket]))
+	for k, v := range s.kv[bucket] {
+		ks = append(ks, k)
+		vs[k] = v
+	}
+	s.l.Unlock()
+	sort.Strings(ks)
+
+	for _, k := range ks {
+		if err := f(k, vs[k]); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* ForEachKVFrom implements Store.ForEachKVFrom */
+func (s *memStore) ForEachKVFrom(
+	bucket, from string,
+	desc bool,
+	f func(k string, v []byte) error,
+) error {
+	/* Snapshot the keys we'll need */
+	s.l.Lock()
+	ks := make([]string, 0, len(s.kv[bucket]))
+	vs := make(map[string][]byte, len(s.kv[bucket]))
+	for k, v := range s.kv[bucket] {
+		if "" != from && ((desc && k > from) || (!desc && k < from)) {
+			continue
+		}
+		ks = append(ks, k)
+		vs[k] = v
+	}
+	s.l.Unlock()
+	sort.Strings(ks)
+	if desc {
+		sort.Sort(sort.Reverse(sort.StringSlice(ks)))
+	}
+
+	for _, k := range ks {
+		if err := f(k, vs[k]); ERRSTOPWALK == err {
+			return nil
+		} else if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Close implements Store.Close */
+func (s *memStore) Close() error { return nil }
@@ -0,0 +1,284 @@
+package main
+
+/*
+ * metrics.go
+ * Prometheus metrics
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+/* Scan outcomes */
+const (
+	OUTCOMEOK    = "ok"    /* Scanned and stored */
+	OUTCOMEERROR = "error" /* Scanned but not stored */
+)
+
+/* Connection error types */
+const (
+	CONNREFUSED     = "refused"
+	CONNTIMEOUT     = "timeout"
+	CONNUNREACHABLE = "unreachable"
+	CONNOTHER       = "other"
+)
+
+/* SCANBUCKETS are the upper bounds, in seconds, of the scan duration
+histogram's buckets */
+var SCANBUCKETS = []float64{1, 5, 15, 30, 60, 120, 300, 600, 900, 1800, 3600}
+
+/* Counters, updated atomically */
+var (
+	METRICCONNS     uint64 /* Connection attempts */
+	METRICOPENPORTS uint64 /* Open ports found */
+	METRICSCANS     = map[string]*uint64{
+		OUTCOMEOK:    new(uint64),
+		OUTCOMEERROR: new(uint64),
+	}
+	METRICCONNERRS = map[string]*uint64{
+		CONNREFUSED:     new(uint64),
+		CONNTIMEOUT:     new(uint64),
+		CONNUNREACHABLE: new(uint64),
+		CONNOTHER:       new(uint64),
+	}
+)
+
+/* Scan duration histogram */
+var (
+	SCANHIST = struct {
+		counts []uint64 /* Per bucket, not cumulative, plus +Inf */
+		sum    float64
+		n      uint64
+	}{counts: make([]uint64, len(SCANBUCKETS)+1)}
+	SCANHISTLOCK = &sync.Mutex{}
+)
+
+/* METRICSPRIVATE is true if metrics are only served on their own listener */
+var METRICSPRIVATE bool
+
+/* countConnection counts a connection attempt which failed with err, which may
+be nil if it succeeded */
+func countConnection(err error) {
+	atomic.AddUint64(&METRICCONNS, 1)
+	if nil == err {
+		return
+	}
+	t := CONNOTHER
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		t = CONNREFUSED
+	case errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		t = CONNUNREACHABLE
+	case errors.As(err, &ne) && ne.Timeout():
+		t = CONNTIMEOUT
+	}
+	atomic.AddUint64(METRICCONNERRS[t], 1)
+}
+
+/* countScan counts a finished scan, which is OUTCOMEERROR if it wasn't
+stored */
+func countScan(r *result, stored bool) {
+	o := OUTCOMEOK
+	if !stored {
+		o = OUTCOMEERROR
+	}
+	atomic.AddUint64(METRICSCANS[o], 1)
+
+	/* Duration */
+	d := r.End.Sub(r.Start).Seconds()
+	i := sort.SearchFloat64s(SCANBUCKETS, d)
+	SCANHISTLOCK.Lock()
+	defer SCANHISTLOCK.Unlock()
+	SCANHIST.counts[i]++
+	SCANHIST.sum += d
+	SCANHIST.n++
+}
+
+/* writeMetric writes a metric's help and type and a sample for each set of
+labels in vs.  Each element of ls is the labels for the value with the same
+index in vs, and may be the empty string. */
+func writeMetric(
+	w io.Writer,
+	name, typ, help string,
+	ls []string,
+	vs []interface{},
+) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+	for i, v := range vs {
+		if "" != ls[i] {
+			fmt.Fprintf(w, "%v{%v} %v\n", name, ls[i], v)
+		} else {
+			fmt.Fprintf(w, "%v %v\n", name, v)
+		}
+	}
+}
+
+/* writeCounters writes a labelled sample for each counter in cs, with the
+label l */
+func writeCounters(
+	w io.Writer,
+	name, help, l string,
+	cs map[string]*uint64,
+	keys ...string,
+) {
+	var (
+		ls []string
+		vs []interface{}
+	)
+	for _, k := range keys {
+		ls = append(ls, fmt.Sprintf("%v=%q", l, k))
+		vs = append(vs, atomic.LoadUint64(cs[k]))
+	}
+	writeMetric(w, name, "counter", help, ls, vs)
+}
+
+/* writeMetrics writes every metric to w in Prometheus' text format */
+func writeMetrics(w io.Writer) {
+	/* Queue */
+	QLOCK.Lock()
+	ql, ns := QUEUE.Len(), len(SCANNING)
+	QLOCK.Unlock()
+	writeMetric(
+		w,
+		"cgiscan_queue_length",
+		"gauge",
+		"Addresses waiting to be scanned.",
+		[]string{""},
+		[]interface{}{ql},
+	)
+	writeMetric(
+		w,
+		"cgiscan_scans_in_progress",
+		"gauge",
+		"Addresses being scanned.",
+		[]string{""},
+		[]interface{}{ns},
+	)
+
+	/* Scans */
+	writeCounters(
+		w,
+		"cgiscan_scans_completed_total",
+		"Scans completed, by outcome.",
+		"outcome",
+		METRICSCANS,
+		OUTCOMEOK, OUTCOMEERROR,
+	)
+	SCANHISTLOCK.Lock()
+	var (
+		ls  []string
+		vs  []interface{}
+		cum uint64
+	)
+	for i, c := range SCANHIST.counts {
+		cum += c
+		le := "+Inf"
+		if i < len(SCANBUCKETS) {
+			le = strconv.FormatFloat(SCANBUCKETS[i], 'g', -1, 64)
+		}
+		ls = append(ls, fmt.Sprintf("le=%q", le))
+		vs = append(vs, cum)
+	}
+	sum, n := SCANHIST.sum, SCANHIST.n
+	SCANHISTLOCK.Unlock()
+	writeMetric(
+		w,
+		"cgiscan_scan_duration_seconds",
+		"histogram",
+		"How long scans take.",
+		nil,
+		nil,
+	)
+	for i, v := range vs {
+		fmt.Fprintf(
+			w,
+			"cgiscan_scan_duration_seconds_bucket{%v} %v\n",
+			ls[i],
+			v,
+		)
+	}
+	fmt.Fprintf(w, "cgiscan_scan_duration_seconds_sum %v\n", sum)
+	fmt.Fprintf(w, "cgiscan_scan_duration_seconds_count %v\n", n)
+
+	/* Connections */
+	writeMetric(
+		w,
+		"cgiscan_connection_attempts_total",
+		"counter",
+		"Connections attempted to scanned ports.",
+		[]string{""},
+		[]interface{}{atomic.LoadUint64(&METRICCONNS)},
+	)
+	writeCounters(
+		w,
+		"cgiscan_connection_errors_total",
+		"Failed connections to scanned ports, by type.",
+		"type",
+		METRICCONNERRS,
+		CONNREFUSED, CONNTIMEOUT, CONNUNREACHABLE, CONNOTHER,
+	)
+	writeMetric(
+		w,
+		"cgiscan_open_ports_found_total",
+		"counter",
+		"Open ports found.",
+		[]string{""},
+		[]interface{}{atomic.LoadUint64(&METRICOPENPORTS)},
+	)
+	writeMetric(
+		w,
+		"cgiscan_start_time_seconds",
+		"gauge",
+		"When cgiscan started, in seconds since the epoch.",
+		[]string{""},
+		[]interface{}{START.Unix()},
+	)
+}
+
+/* sendMetrics sends back the metrics in Prometheus' text format.  If metrics
+are served on their own listener, the public copy is not found. */
+func sendMetrics(w http.ResponseWriter, req *http.Request) {
+	if METRICSPRIVATE {
+		http.NotFound(w, req)
+		return
+	}
+	serveMetrics(w, req)
+}
+
+/* serveMetrics sends back the metrics in Prometheus' text format */
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	var b bytes.Buffer
+	writeMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	b.WriteTo(w)
+	debug("%v Sent metrics", req.RemoteAddr)
+}
+
+/* metricsListener serves metrics, and only metrics, over HTTP on addr */
+func metricsListener(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		log.Fatalf("Unable to listen for metrics on %v: %v", addr, err)
+	}
+	log.Printf("Serving metrics on %v", l.Addr())
+	listenerUp("metrics", l)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	log.Fatalf("Error serving metrics: %v", http.Serve(l, mux))
+}
@@ -0,0 +1,231 @@
+package main
+
+/*
+ * nmapxml.go
+ * Results in nmap's XML format
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+/* NMAPXMLVERSION is the version of nmap's XML output we produce */
+const NMAPXMLVERSION = "1.05"
+
+/* nmapStatus is a host's or port's state */
+type nmapStatus struct {
+	State     string `xml:"state,attr"`
+	Reason    string `xml:"reason,attr"`
+	ReasonTTL int    `xml:"reason_ttl,attr"`
+}
+
+/* nmapAddress is a host's address */
+type nmapAddress struct {
+	Addr     string `xml:"addr,attr"`
+	AddrType string `xml:"addrtype,attr"`
+}
+
+/* nmapService is the service nmap thinks is on a port */
+type nmapService struct {
+	Name   string `xml:"name,attr"`
+	Method string `xml:"method,attr"`
+	Conf   int    `xml:"conf,attr"`
+}
+
+/* nmapScript is the output of an NSE script.  We use it for banners, as
+nmap's banner script does. */
+type nmapScript struct {
+	ID     string `xml:"id,attr"`
+	Output string `xml:"output,attr"`
+}
+
+/* nmapPort is an open port */
+type nmapPort struct {
+	Protocol string       `xml:"protocol,attr"`
+	PortID   int          `xml:"portid,attr"`
+	State    nmapStatus   `xml:"state"`
+	Service  *nmapService `xml:"service,omitempty"`
+	Scripts  []nmapScript `xml:"script"`
+}
+
+/* nmapExtraPorts summarizes the ports which weren't open */
+type nmapExtraPorts struct {
+	State string `xml:"state,attr"`
+	Count int    `xml:"count,attr"`
+}
+
+/* nmapHost is a scanned host */
+type nmapHost struct {
+	XMLName   xml.Name      `xml:"host"`
+	StartTime int64         `xml:"starttime,attr,omitempty"`
+	EndTime   int64         `xml:"endtime,attr,omitempty"`
+	Status    nmapStatus    `xml:"status"`
+	Addresses []nmapAddress `xml:"address"`
+	Hostnames struct{}      `xml:"hostnames"`
+	Ports     struct {
+		Extra *nmapExtraPorts `xml:"extraports,omitempty"`
+		Ports []nmapPort      `xml:"port"`
+	} `xml:"ports"`
+}
+
+/* nmapHostFromResult converts r into an nmapHost.  Hosts are always reported
+as up, as they were scanned regardless.  Ports which weren't open are reported
+as closed, as we can't tell closed from filtered. */
+func nmapHostFromResult(r *result) nmapHost {
+	h := nmapHost{
+		Status: nmapStatus{State: "up", Reason: "user-set"},
+	}
+	if !r.Start.IsZero() {
+		h.StartTime = r.Start.Unix()
+	}
+	if !r.End.IsZero() {
+		h.EndTime = r.End.Unix()
+	}
+
+	/* Address */
+	at := "ipv6"
+	if nil != net.ParseIP(r.Addr).To4() {
+		at = "ipv4"
+	}
+	h.Addresses = []nmapAddress{{Addr: r.Addr, AddrType: at}}
+
+	/* Old results don't have ports we can use */
+	if nil != r.Legacy {
+		return h
+	}
+
+	/* Ports */
+	if 0 != len(r.Ports) {
+		h.Status.Reason = "syn-ack"
+	}
+	h.Ports.Extra = &nmapExtraPorts{
+		State: "closed",
+		Count: 65535 - len(r.Ports),
+	}
+	for _, p := range r.Ports {
+		np := nmapPort{
+			Protocol: "tcp",
+			PortID:   p.Port,
+			State:    nmapStatus{State: "open", Reason: "syn-ack"},
+		}
+		/* Services from banners are more trustworthy */
+		if s := reportService(p); "unknown" != s {
+			np.Service = &nmapService{
+				Name:   s,
+				Method: "table",
+				Conf:   3,
+			}
+			if s == serviceFromBanner(p.Banner) {
+				np.Service.Method = "probed"
+				np.Service.Conf = 10
+			}
+		}
+		if 0 != len(p.Banner) {
+			np.Scripts = []nmapScript{{
+				ID:     "banner",
+				Output: quoteBanner(p.Banner),
+			}}
+		}
+		h.Ports.Ports = append(h.Ports.Ports, np)
+	}
+	return h
+}
+
+/* nmapWriter writes results as an nmap XML document */
+type nmapWriter struct {
+	w     io.Writer
+	enc   *xml.Encoder
+	start time.Time
+	n     int
+}
+
+/* newNmapWriter starts an nmap XML document on w for a run which started at
+start */
+func newNmapWriter(w io.Writer, start time.Time) (*nmapWriter, error) {
+	if _, err := fmt.Fprintf(
+		w,
+		`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE nmaprun>
+<nmaprun scanner="cgiscan" args="cgiscan" start="%v" startstr="%v" `+
+			`xmloutputversion="%v">
+<scaninfo type="connect" protocol="tcp" numservices="65535" `+
+			`services="1-65535"/>
+<verbose level="0"/>
+<debugging level="0"/>
+`,
+		start.Unix(),
+		start.Format(time.ANSIC),
+		NMAPXMLVERSION,
+	); nil != err {
+		return nil, err
+	}
+	return &nmapWriter{w: w, enc: xml.NewEncoder(w), start: start}, nil
+}
+
+/* Write writes r as a host */
+func (nw *nmapWriter) Write(r *result) error {
+	if err := nw.enc.Encode(nmapHostFromResult(r)); nil != err {
+		return err
+	}
+	nw.n++
+	_, err := io.WriteString(nw.w, "\n")
+	return err
+}
+
+/* Close finishes the document, for a run which finished at end */
+func (nw *nmapWriter) Close(end time.Time) error {
+	_, err := fmt.Fprintf(
+		nw.w,
+		`<runstats>
+<finished time="%v" timestr="%v" elapsed="%.2f" summary="cgiscan done; `+
+			`%v IP addresses (%v hosts up) scanned" exit="success"/>
+<hosts up="%v" down="0" total="%v"/>
+</runstats>
+</nmaprun>
+`,
+		end.Unix(),
+		end.Format(time.ANSIC),
+		end.Sub(nw.start).Seconds(),
+		nw.n, nw.n,
+		nw.n, nw.n,
+	)
+	return err
+}
+
+/* writeNmapXML writes rs to w as a single nmap XML document */
+func writeNmapXML(w io.Writer, rs ...*result) error {
+	/* The run lasted as long as the scans */
+	var start, end time.Time
+	for _, r := range rs {
+		if start.IsZero() || r.Start.Before(start) {
+			start = r.Start
+		}
+		if r.End.After(end) {
+			end = r.End
+		}
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	if start.IsZero() {
+		start = end
+	}
+
+	nw, err := newNmapWriter(w, start)
+	if nil != err {
+		return err
+	}
+	for _, r := range rs {
+		if err := nw.Write(r); nil != err {
+			return err
+		}
+	}
+	return nw.Close(end)
+}
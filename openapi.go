@@ -0,0 +1,904 @@
+package main
+
+/*
+ * openapi.go
+ * OpenAPI description of the HTTP interface
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* OPENAPIPATH is the URL path, after URLPATH, of the OpenAPI document */
+const OPENAPIPATH = "/openapi.json"
+
+/* registeredRoute is a route and the methods its handler is given */
+type registeredRoute struct {
+	pattern string
+	methods []string
+}
+
+/* Registered routes, after URLPATH for ROUTES, to check against APISPEC */
+var (
+	ROUTES      []registeredRoute
+	ADMINROUTES []registeredRoute
+)
+
+/* route registers h to handle requests for URLPATH+pattern with one of the
+methods ms and notes the route has to be in APISPEC */
+func route(pattern string, h http.HandlerFunc, ms ...string) {
+	p := URLPATH + pattern
+	if "" == p {
+		p = "/"
+	}
+	http.HandleFunc(p, allowMethods(
+		strings.HasPrefix(pattern, APIPATH+"/"),
+		ms,
+		h,
+	))
+	ROUTES = append(ROUTES, registeredRoute{pattern, ms})
+}
+
+/* adminRoute registers h to handle requests to the admin socket for pattern
+with one of the methods ms and notes the route has to be in APISPEC */
+func adminRoute(pattern string, h http.HandlerFunc, ms ...string) {
+	ADMINMUX.HandleFunc(pattern, allowMethods(false, ms, h))
+	ADMINROUTES = append(ADMINROUTES, registeredRoute{pattern, ms})
+}
+
+/* allowMethods wraps h so it's only given requests with one of the methods
+ms, or HEAD if ms has GET.  Others get a 405, as JSON if api is true.  If ms is
+empty, h is given every request. */
+func allowMethods(api bool, ms []string, h http.HandlerFunc) http.HandlerFunc {
+	if 0 == len(ms) {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, m := range ms {
+			if m == req.Method || (http.MethodGet == m &&
+				http.MethodHead == req.Method) {
+				h(w, req)
+				return
+			}
+		}
+		if api {
+			apiMethod(w, req, ms...)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(ms, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method %v not allowed.\n", req.Method)
+	}
+}
+
+/* specParam is a query, path, or header parameter.  Path and header
+parameters are required. */
+type specParam struct {
+	name string
+	in   string
+	desc string
+}
+
+/* specOp is an operation on a path */
+type specOp struct {
+	method  string
+	summary string
+	params  []specParam
+	status  int         /* Success status */
+	failure int         /* Status, with the same body, on failure */
+	types   []string    /* Response Content-Types */
+	body    interface{} /* JSON response body, if any */
+	reqType string      /* Request Content-Type, if there's a body */
+}
+
+/* specPath describes an OpenAPI path.  More than one may be served by the
+same route.  A specPath with no path is a route which deliberately isn't
+described. */
+type specPath struct {
+	route string /* Pattern given to route or adminRoute */
+	path  string /* OpenAPI path, after URLPATH */
+	admin bool   /* Served on the admin socket */
+	tag   string
+	ops   []specOp
+}
+
+/* Parameters used by more than one operation */
+var (
+	FORMATPARAM = specParam{
+		"format",
+		"query",
+		"Output format, one of html, text, json, csv, markdown, or " +
+			"nmapxml; overrides the Accept header",
+	}
+	ADDRESSPARAM = specParam{"address", "path", "IP address"}
+	LABELPARAM   = specParam{"label", "query", "Only addresses with label"}
+	APICSRFPARAM = specParam{
+		APICSRFHEADER,
+		"header",
+		"Any value, to show the request isn't forged",
+	}
+	SEARCHPARAMS = []specParam{
+		{"q", "query", "Substring for which to search"},
+		{"re", "query", "Regular expression for which to search"},
+		{"field", "query", "Only search banner or service"},
+		{"port", "query", "Only search this port"},
+	}
+	FILTERPARAMS = []specParam{
+		{"net", "query", "Only addresses in this CIDR range"},
+		{"since", "query", "Only results finished on or after this " +
+			"time (RFC3339 or YYYY-MM-DD)"},
+		{"until", "query", "Only results finished on or before this " +
+			"time (RFC3339 or YYYY-MM-DD)"},
+	}
+)
+
+/* Content-Types used by more than one operation */
+var (
+	HTMLTYPES   = []string{FORMATTYPES[FORMATHTML]}
+	TEXTTYPES   = []string{FORMATTYPES[FORMATTEXT]}
+	JSONTYPES   = []string{FORMATTYPES[FORMATJSON]}
+	FORMATTED   = sortedFormatTypes()
+	NDJSONTYPES = []string{EXPORTTYPES[EXPORTJSONL]}
+)
+
+/* sortedFormatTypes returns the Content-Types of the formats in which pages
+may be served */
+func sortedFormatTypes() []string {
+	var ts []string
+	for _, f := range sortedFormats() {
+		ts = append(ts, FORMATTYPES[f])
+	}
+	return ts
+}
+
+/* APISPEC describes every route.  checkAPISpec makes sure it's complete. */
+var APISPEC = []specPath{
+	/* Pages */
+	{route: "", path: "/", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Requestor's status and latest result",
+		params:  []specParam{FORMATPARAM},
+		types:   FORMATTED,
+		body:    apiStatus{},
+	}}},
+	{route: "/status", path: "/status", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Requestor's status and latest result",
+		params:  []specParam{FORMATPARAM},
+		types:   FORMATTED,
+		body:    apiStatus{},
+	}}},
+	{route: "/scan", path: "/scan", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Form to confirm scanning the requestor",
+		types:   HTMLTYPES,
+	}, {
+		method:  http.MethodPost,
+		summary: "Queue the requestor for scanning",
+		status:  http.StatusSeeOther,
+		reqType: "application/x-www-form-urlencoded",
+	}}},
+	{route: "/res/", path: "/res/{address}", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Latest result for an address",
+		params:  []specParam{ADDRESSPARAM, FORMATPARAM},
+		types:   FORMATTED,
+		body:    apiResult{},
+	}}},
+	{route: "/res/", path: "/res/{address}/{id}.json", tag: "pages",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Signed report for one scan",
+			params: []specParam{
+				ADDRESSPARAM,
+				{"id", "path", "Scan ID"},
+			},
+			types: JSONTYPES,
+			body:  result{},
+		}}},
+	{route: "/res/", path: "/res/{address}/{id}.sig", tag: "pages",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Base64-encoded Ed25519 signature of a report",
+			params: []specParam{
+				ADDRESSPARAM,
+				{"id", "path", "Scan ID"},
+			},
+			types: []string{"text/plain"},
+		}}},
+	{route: "/list", path: "/list", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Scanned addresses, a page at a time",
+		params: append(append([]specParam{LABELPARAM}, FILTERPARAMS...),
+			specParam{"min_ports", "query", "Minimum open ports"},
+			specParam{"max_ports", "query", "Maximum open ports"},
+			specParam{"sort", "query", "address, date, or ports"},
+			specParam{"order", "query", "asc or desc"},
+			specParam{"n", "query", "Addresses per page"},
+			specParam{"after", "query", "Cursor from the last page"},
+		),
+		types: HTMLTYPES,
+	}}},
+	{route: "/delete", path: "/delete", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Form to confirm deleting the requestor's results",
+		types:   HTMLTYPES,
+	}, {
+		method:  http.MethodPost,
+		summary: "Delete the requestor's results",
+		types:   TEXTTYPES,
+		reqType: "application/x-www-form-urlencoded",
+	}}},
+	{route: "/share", path: "/share", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Form to confirm making a share link",
+		params: []specParam{
+			{"id", "query", "Scan ID, by default the latest"},
+			{"expires", "query", "Link lifetime, e.g. 24h"},
+		},
+		types: HTMLTYPES,
+	}, {
+		method:  http.MethodPost,
+		summary: "Make a link to one of the requestor's scans",
+		status:  http.StatusSeeOther,
+		reqType: "application/x-www-form-urlencoded",
+	}}},
+	{route: "/unshare", path: "/unshare", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Form to confirm revoking a share link",
+		params:  []specParam{{"token", "query", "Share token"}},
+		types:   HTMLTYPES,
+	}, {
+		method:  http.MethodPost,
+		summary: "Revoke one of the requestor's share links",
+		status:  http.StatusSeeOther,
+		reqType: "application/x-www-form-urlencoded",
+	}}},
+	{route: SHAREPATH, path: SHAREPATH + "{token}", tag: "pages",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Shared scan result",
+			params: []specParam{
+				{"token", "path", "Share token"},
+				FORMATPARAM,
+			},
+			types: FORMATTED,
+			body:  apiResult{},
+		}}},
+	{route: SHAREPATH, path: SHAREPATH + "{token}.json", tag: "pages",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Signed report for a shared scan",
+			params:  []specParam{{"token", "path", "Share token"}},
+			types:   JSONTYPES,
+			body:    result{},
+		}}},
+	{route: SHAREPATH, path: SHAREPATH + "{token}.sig", tag: "pages",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Signature of a shared scan's report",
+			params:  []specParam{{"token", "path", "Share token"}},
+			types:   []string{"text/plain"},
+		}}},
+	{route: BADGEPATH, path: BADGEPATH + "{address}.svg", tag: "pages",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "SVG badge with an address' open ports and last scan",
+			params:  []specParam{ADDRESSPARAM},
+			types:   []string{"image/svg+xml"},
+		}}},
+	{route: "/metrics", path: "/metrics", tag: "pages", ops: []specOp{{
+		method: http.MethodGet,
+		summary: "Prometheus metrics, unless served on their own " +
+			"listener",
+		types: []string{"text/plain"},
+	}}},
+	{route: "/healthz", path: "/healthz", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Check the database and scanner",
+		failure: http.StatusServiceUnavailable,
+		types:   TEXTTYPES,
+	}}},
+	{route: "/readyz", path: "/readyz", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Check the database, scanner, and listeners",
+		failure: http.StatusServiceUnavailable,
+		types:   TEXTTYPES,
+	}}},
+	{route: "/help", path: "/help", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Help",
+		types:   HTMLTYPES,
+	}}},
+	{route: "/queue", path: "/queue", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Addresses being scanned and in the queue",
+		types:   HTMLTYPES,
+	}}},
+	{route: "/stats", path: "/stats", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Scan statistics by day",
+		types:   HTMLTYPES,
+	}}},
+	{route: "/search", path: "/search", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Search banners and services",
+		params:  SEARCHPARAMS,
+		types:   HTMLTYPES,
+	}}},
+	{route: "/port/", path: "/port/{port}", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Addresses with a port open",
+		params:  []specParam{{"port", "path", "Port number"}},
+		types:   HTMLTYPES,
+	}}},
+	{route: "/port/", path: "/port/{port}/tcp", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Addresses with a port open",
+		params:  []specParam{{"port", "path", "Port number"}},
+		types:   HTMLTYPES,
+	}}},
+	{route: "/ports", path: "/ports", tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Most common open ports",
+		params:  []specParam{{"n", "query", "Number of ports"}},
+		types:   HTMLTYPES,
+	}}},
+	{route: "/events", path: "/events", tag: "pages", ops: []specOp{{
+		method: http.MethodGet,
+		summary: "Server-Sent Events with the requestor's queue " +
+			"position and scan progress",
+		types: []string{"text/event-stream"},
+	}}},
+	{route: STATICPATH, path: STATICPATH + "{file}", tag: "pages",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Static file, such as the stylesheet",
+			params:  []specParam{{"file", "path", "File name"}},
+		}}},
+	{route: PUBKEYPATH, path: PUBKEYPATH, tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "Public key with which reports are signed",
+		types:   []string{"application/x-pem-file"},
+	}}},
+	{route: OPENAPIPATH, path: OPENAPIPATH, tag: "pages", ops: []specOp{{
+		method:  http.MethodGet,
+		summary: "This document",
+		types:   JSONTYPES,
+	}}},
+
+	/* JSON API */
+	{route: APIPATH + "/"}, /* Not found, for everything else */
+	{route: APIPATH + "/status", path: APIPATH + "/status", tag: "api",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Requestor's status and latest result",
+			types:   JSONTYPES,
+			body:    apiStatus{},
+		}}},
+	{route: APIPATH + "/scan", path: APIPATH + "/scan", tag: "api",
+		ops: []specOp{{
+			method:  http.MethodPost,
+			summary: "Queue the requestor for scanning",
+			params:  []specParam{APICSRFPARAM},
+			status:  http.StatusAccepted,
+			types:   JSONTYPES,
+			body:    apiState{},
+		}}},
+	{route: APIPATH + "/res/", path: APIPATH + "/res/{address}", tag: "api",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Latest result for an address",
+			params:  []specParam{ADDRESSPARAM},
+			types:   JSONTYPES,
+			body:    apiResult{},
+		}}},
+	{route: APIPATH + "/list", path: APIPATH + "/list", tag: "api",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Scanned addresses",
+			params:  []specParam{LABELPARAM},
+			types:   JSONTYPES,
+			body: struct {
+				Addrs []string `json:"addresses"`
+			}{},
+		}}},
+	{route: APIPATH + "/queue", path: APIPATH + "/queue", tag: "api",
+		ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Addresses being scanned and in the queue",
+			types:   JSONTYPES,
+			body: struct {
+				Scanning []apiQaddr `json:"scanning"`
+				Queued   []apiQaddr `json:"queued"`
+			}{},
+		}}},
+	{route: APIPATH + "/delete", path: APIPATH + "/delete", tag: "api",
+		ops: []specOp{{
+			method:  http.MethodPost,
+			summary: "Delete the requestor's results",
+			params:  []specParam{APICSRFPARAM},
+			status:  http.StatusNoContent,
+		}, {
+			method:  http.MethodDelete,
+			summary: "Delete the requestor's results",
+			params:  []specParam{APICSRFPARAM},
+			status:  http.StatusNoContent,
+		}}},
+
+	/* Admin socket */
+	{route: "/admin/export", path: "/admin/export", admin: true,
+		tag: "admin", ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Export results",
+			params: append(FILTERPARAMS, specParam{
+				"format",
+				"query",
+				"jsonl or nmapxml",
+			}),
+			types: append(NDJSONTYPES, "application/xml"),
+			body:  result{},
+		}}},
+	{route: "/admin/import", path: "/admin/import", admin: true,
+		tag: "admin", ops: []specOp{{
+			method:  http.MethodPost,
+			summary: "Import JSON Lines results",
+			types:   TEXTTYPES,
+			reqType: EXPORTTYPES[EXPORTJSONL],
+		}}},
+	{route: "/admin/search", path: "/admin/search", admin: true,
+		tag: "admin", ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Search banners and services, as plain text " +
+				"or, for browsers, the search page",
+			params: append([]specParam{{
+				"format",
+				"query",
+				"html for the search page, otherwise plain " +
+					"text; overrides the Accept header",
+			}}, SEARCHPARAMS...),
+			types: []string{
+				FORMATTYPES[FORMATTEXT],
+				FORMATTYPES[FORMATHTML],
+			},
+		}}},
+	{route: "/admin/backup", path: "/admin/backup", admin: true,
+		tag: "admin", ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Back up the database",
+			params: []specParam{
+				{"gzip", "query", "Compress the backup if true"},
+			},
+			types: []string{"application/octet-stream"},
+		}}},
+	{route: "/admin/annotate", path: "/admin/annotate", admin: true,
+		tag: "admin", ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Get an address' annotation",
+			params: []specParam{
+				{"address", "query", "IP address"},
+			},
+			types: JSONTYPES,
+			body:  annotation{},
+		}, {
+			method:  http.MethodPost,
+			summary: "Replace an address' annotation",
+			params: []specParam{
+				{"address", "query", "IP address"},
+			},
+			types:   JSONTYPES,
+			body:    annotation{},
+			reqType: "application/x-www-form-urlencoded",
+		}}},
+	{route: "/admin/delete", path: "/admin/delete", admin: true,
+		tag: "admin", ops: []specOp{{
+			method:  http.MethodPost,
+			summary: "Delete any address' results",
+			params: []specParam{
+				{"address", "query", "IP address"},
+			},
+			types:   TEXTTYPES,
+			reqType: "application/x-www-form-urlencoded",
+		}, {
+			method:  http.MethodDelete,
+			summary: "Delete any address' results",
+			params: []specParam{
+				{"address", "query", "IP address"},
+			},
+			types: TEXTTYPES,
+		}}},
+	{route: "/admin/queue", path: "/admin/queue", admin: true,
+		tag: "admin", ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Every address being scanned and in the queue",
+			types:   JSONTYPES,
+			body: struct {
+				Scanning []apiQaddr `json:"scanning"`
+				Queued   []apiQaddr `json:"queued"`
+			}{},
+		}, {
+			method:  http.MethodPost,
+			summary: "Remove an address from the queue",
+			params: []specParam{
+				{"address", "query", "IP address"},
+			},
+			types: JSONTYPES,
+			body: struct {
+				Scanning []apiQaddr `json:"scanning"`
+				Queued   []apiQaddr `json:"queued"`
+			}{},
+			reqType: "application/x-www-form-urlencoded",
+		}, {
+			method:  http.MethodDelete,
+			summary: "Remove an address from the queue",
+			params: []specParam{
+				{"address", "query", "IP address"},
+			},
+			types: JSONTYPES,
+			body: struct {
+				Scanning []apiQaddr `json:"scanning"`
+				Queued   []apiQaddr `json:"queued"`
+			}{},
+		}}},
+	{route: ADMINVIEWPATH + "/res/", path: ADMINVIEWPATH + "/res/{address}",
+		admin: true, tag: "admin", ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Latest result for any address",
+			params:  []specParam{ADDRESSPARAM, FORMATPARAM},
+			types:   FORMATTED,
+			body:    apiResult{},
+		}}},
+	{route: ADMINVIEWPATH + "/port/", path: ADMINVIEWPATH + "/port/{port}",
+		admin: true, tag: "admin", ops: []specOp{{
+			method:  http.MethodGet,
+			summary: "Every address with a port open",
+			params:  []specParam{{"port", "path", "Port number"}},
+			types:   HTMLTYPES,
+		}}},
+}
+
+/* checkAPISpec makes sure every registered route is in APISPEC and every
+route in APISPEC is registered, so the two stay in sync. */
+func checkAPISpec() error {
+	/* Routes in the spec, with their methods */
+	specced := make(map[string]map[string]bool)
+	for _, sp := range APISPEC {
+		k := fmt.Sprintf("%v %v", sp.admin, sp.route)
+		if nil == specced[k] {
+			specced[k] = make(map[string]bool)
+		}
+		for _, op := range sp.ops {
+			specced[k][op.method] = true
+		}
+	}
+
+	/* Registered routes */
+	var missing, wrong []string
+	registered := make(map[string]bool)
+	for _, rs := range []struct {
+		admin  bool
+		routes []registeredRoute
+	}{{false, ROUTES}, {true, ADMINROUTES}} {
+		for _, r := range rs.routes {
+			k := fmt.Sprintf("%v %v", rs.admin, r.pattern)
+			registered[k] = true
+			sms, ok := specced[k]
+			if !ok {
+				missing = append(
+					missing,
+					strconv.Quote(r.pattern),
+				)
+				continue
+			}
+			if !sameMethods(sms, r.methods) {
+				wrong = append(wrong, strconv.Quote(r.pattern))
+			}
+		}
+	}
+	if 0 != len(missing) {
+		return fmt.Errorf(
+			"no OpenAPI description for %v",
+			strings.Join(missing, ", "),
+		)
+	}
+	if 0 != len(wrong) {
+		return fmt.Errorf(
+			"OpenAPI description has the wrong methods for %v",
+			strings.Join(wrong, ", "),
+		)
+	}
+
+	/* Described routes */
+	var extra []string
+	for k := range specced {
+		if !registered[k] {
+			extra = append(extra, strconv.Quote(k[strings.Index(k, " ")+1:]))
+		}
+	}
+	if 0 != len(extra) {
+		sort.Strings(extra)
+		return fmt.Errorf(
+			"OpenAPI description for unregistered %v",
+			strings.Join(extra, ", "),
+		)
+	}
+	return nil
+}
+
+/* sameMethods returns true if the methods in the spec, sms, are the methods
+ms.  A route with no methods in the spec isn't described, and may be given any
+method. */
+func sameMethods(sms map[string]bool, ms []string) bool {
+	if len(sms) != len(ms) {
+		return false
+	}
+	for _, m := range ms {
+		if !sms[m] {
+			return false
+		}
+	}
+	return true
+}
+
+/* openAPIDoc builds the OpenAPI document from APISPEC */
+func openAPIDoc() map[string]interface{} {
+	server := URLPATH
+	if "" == server {
+		server = "/"
+	}
+	paths := make(map[string]interface{})
+	for _, sp := range APISPEC {
+		if "" == sp.path {
+			continue
+		}
+		item := make(map[string]interface{})
+		if sp.admin {
+			ss := []map[string]string{{
+				"url":         "http://cgiscan",
+				"description": "Admin socket",
+			}}
+			if adminAuthEnabled() {
+				ss = append(ss, map[string]string{
+					"url":         server,
+					"description": "Authenticated",
+				})
+			}
+			item["servers"] = ss
+		}
+		for _, op := range sp.ops {
+			item[strings.ToLower(op.method)] = openAPIOp(sp, op)
+		}
+		paths[sp.path] = item
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   SITE.Title,
+			"version": strings.TrimPrefix(APIPATH, "/api/"),
+		},
+		"servers": []map[string]string{{"url": server}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"basic": map[string]string{
+					"type":   "http",
+					"scheme": "basic",
+				},
+				"bearer": map[string]string{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+/* openAPIOp builds the OpenAPI operation for op on sp */
+func openAPIOp(sp specPath, op specOp) map[string]interface{} {
+	o := map[string]interface{}{
+		"summary": op.summary,
+		"tags":    []string{sp.tag},
+	}
+
+	/* Admin requests over HTTP need credentials; via the socket they
+	don't */
+	if sp.admin && adminAuthEnabled() {
+		o["security"] = []map[string][]string{
+			{"basic": {}},
+			{"bearer": {}},
+			{},
+		}
+	}
+
+	/* Parameters */
+	var ps []map[string]interface{}
+	for _, p := range op.params {
+		ps = append(ps, map[string]interface{}{
+			"name":        p.name,
+			"in":          p.in,
+			"description": p.desc,
+			"required":    "path" == p.in || "header" == p.in,
+			"schema":      map[string]string{"type": "string"},
+		})
+	}
+	if 0 != len(ps) {
+		o["parameters"] = ps
+	}
+	if "" != op.reqType {
+		o["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				op.reqType: map[string]interface{}{},
+			},
+		}
+	}
+
+	/* Responses */
+	status := op.status
+	if 0 == status {
+		status = http.StatusOK
+	}
+	res := map[string]interface{}{
+		"description": http.StatusText(status),
+	}
+	if 0 != len(op.types) {
+		content := make(map[string]interface{})
+		for _, t := range op.types {
+			t = strings.TrimSpace(strings.Split(t, ";")[0])
+			mt := make(map[string]interface{})
+			if nil != op.body && strings.HasSuffix(t, "json") {
+				mt["schema"] = jsonSchema(reflect.TypeOf(op.body))
+			}
+			content[t] = mt
+		}
+		res["content"] = content
+	}
+	rs := map[string]interface{}{strconv.Itoa(status): res}
+	if 0 != op.failure {
+		rs[strconv.Itoa(op.failure)] = map[string]interface{}{
+			"description": http.StatusText(op.failure),
+			"content":     res["content"],
+		}
+	}
+	if "api" == sp.tag {
+		rs["default"] = map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": jsonSchema(
+						reflect.TypeOf(apiError{}),
+					),
+				},
+			},
+		}
+	}
+	o["responses"] = rs
+	return o
+}
+
+/* jsonSchema returns the schema for t, as encoding/json would encode it */
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	/* Special cases */
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{
+			"type":   "string",
+			"format": "date-time",
+		}
+	case reflect.TypeOf([]byte{}):
+		return map[string]interface{}{
+			"type":   "string",
+			"format": "byte",
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := jsonSchema(t.Elem())
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": jsonSchema(t.Elem()),
+		}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		addStructFields(t, props, &required)
+		s := map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+		if 0 != len(required) {
+			sort.Strings(required)
+			s["required"] = required
+		}
+		return s
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+/* addStructFields adds the JSON-encoded fields of the struct type t to
+props, and the ones without omitempty to required.  Embedded structs' fields
+are added as encoding/json would. */
+func addStructFields(
+	t reflect.Type,
+	props map[string]interface{},
+	required *[]string,
+) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if "-" == tag {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		/* Embedded structs without names get flattened */
+		ft := f.Type
+		if reflect.Ptr == ft.Kind() {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && "" == name && reflect.Struct == ft.Kind() {
+			addStructFields(ft, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if "" == name {
+			name = f.Name
+		}
+		props[name] = jsonSchema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+/* sendOpenAPI sends back the OpenAPI document */
+func sendOpenAPI(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(openAPIDoc()); nil != err {
+		debug("%v Error sending OpenAPI document: %v", rip, err)
+		return
+	}
+	debug("%v Sent OpenAPI document", rip)
+}
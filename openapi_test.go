@@ -0,0 +1,52 @@
+package main
+
+/*
+ * openapi_test.go
+ * Make sure the OpenAPI description covers every route
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPISpec(t *testing.T) {
+	registerRoutes()
+	if err := checkAPISpec(); nil != err {
+		t.Fatalf("OpenAPI description out of date: %v", err)
+	}
+
+	/* Handlers should only be given the methods in the description */
+	for _, rs := range []struct {
+		mux    *http.ServeMux
+		routes []registeredRoute
+	}{{http.DefaultServeMux, ROUTES}, {ADMINMUX, ADMINROUTES}} {
+		for _, r := range rs.routes {
+			if 0 == len(r.methods) {
+				continue
+			}
+			p := URLPATH + r.pattern
+			if "" == p {
+				p = "/"
+			}
+			rec := httptest.NewRecorder()
+			rs.mux.ServeHTTP(rec, httptest.NewRequest(
+				http.MethodPatch,
+				p,
+				nil,
+			))
+			if http.StatusMethodNotAllowed != rec.Code {
+				t.Errorf(
+					"PATCH %q: got %v, want %v",
+					p,
+					rec.Code,
+					http.StatusMethodNotAllowed,
+				)
+			}
+		}
+	}
+}
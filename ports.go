@@ -0,0 +1,160 @@
+package main
+
+/*
+ * ports.go
+ * Port-centric queries
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* DEFTOPPORTS is the default number of ports on the summary page */
+const DEFTOPPORTS = 100
+
+/* portCount is the number of addresses with a port open, and the service
+usually on the port */
+type portCount struct {
+	Port    int
+	Count   int
+	Service string
+}
+
+/* portHosts lists the hosts whose latest scan has the port in the URL open.
+The URL's path should end in /port/<n> or /port/<n>/tcp. */
+func portHosts(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Work out the port and protocol */
+	parts := strings.Split(
+		strings.Trim(strings.TrimPrefix(
+			req.URL.Path,
+			URLPATH+"/port/",
+		), "/"),
+		"/",
+	)
+	if 2 < len(parts) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "The URL must end in /port/<n> or "+
+			"/port/<n>/<proto>.")
+		return
+	}
+	port, err := strconv.Atoi(parts[0])
+	if nil != err || 1 > port || 65535 < port {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, fmt.Sprintf(
+			"Invalid port %q.",
+			html.EscapeString(parts[0]),
+		))
+		return
+	}
+	if 2 == len(parts) && "tcp" != strings.ToLower(parts[1]) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "Only TCP ports are scanned.")
+		return
+	}
+
+	/* Find the hosts with it open */
+	hits, err := portHits(port)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Send them back */
+	hits = visibleHits(req, rip, hits)
+	if err := renderPage(w, "port.html", struct {
+		Port     int
+		Hits     []searchHit
+		ViewPath string /* From viewPath */
+	}{port, hits, viewPath(req)}); nil != err {
+		return
+	}
+
+	debug("%v Sent %v hosts with port %v open", rip, len(hits), port)
+}
+
+/* topPorts sends back the most common open ports.  The number of ports may be
+given with the n query parameter. */
+func topPorts(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Work out how many to send */
+	n := DEFTOPPORTS
+	if s := req.URL.Query().Get("n"); "" != s {
+		if n, err = strconv.Atoi(s); nil != err || 1 > n {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Invalid number of ports.")
+			return
+		}
+	}
+
+	/* Count up the ports */
+	var (
+		counts = make(map[int]int)
+		nhost  int
+		last   string
+	)
+	if err := forEachLatestPort(func(a string, p portRes) error {
+		counts[p.Port]++
+		if a != last {
+			nhost++
+			last = a
+		}
+		return nil
+	}); nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	pcs := make([]portCount, 0, len(counts))
+	for p, c := range counts {
+		pcs = append(pcs, portCount{
+			Port:    p,
+			Count:   c,
+			Service: PORTSERVICES[p],
+		})
+	}
+	sort.Slice(pcs, func(i, j int) bool {
+		if pcs[i].Count != pcs[j].Count {
+			return pcs[i].Count > pcs[j].Count
+		}
+		return pcs[i].Port < pcs[j].Port
+	})
+	if len(pcs) > n {
+		pcs = pcs[:n]
+	}
+
+	/* Send them back */
+	if err := renderPage(w, "ports.html", struct {
+		NHosts int
+		Ports  []portCount
+	}{nhost, pcs}); nil != err {
+		return
+	}
+
+	debug("%v Sent %v most common ports", rip, len(pcs))
+}
@@ -34,6 +34,7 @@ func qsock(path string) {
 		log.Fatalf("ERROR: Unable to listen on %v: %v", path, err)
 	}
 	log.Printf("Listening for local queue requests on %v", l.Addr())
+	listenerUp("queue", l)
 
 	/* Handle requests */
 	for {
@@ -5,7 +5,7 @@ package main
  * Query for an IP's last scan
  * By J. Stuart McMurray
  * Created 20160705
- * Last Modified 20160708
+ * Last Modified 20261018
  */
 
 import (
@@ -14,85 +14,156 @@ import (
 	"net"
 	"net/http"
 	"strings"
-
-	"github.com/boltdb/bolt"
 )
 
 /* Query returns the last scan results for a given IP */
 func query(w http.ResponseWriter, req *http.Request) {
-	/* Pull out query address, if any */
-	parts := strings.Split(req.URL.Path, "/")
-	addr := parts[len(parts)-1]
+	/* Pull out query address, if any, and maybe a scan file */
+	parts := strings.Split(
+		strings.TrimPrefix(req.URL.Path, URLPATH+"/res/"),
+		"/",
+	)
+	addr := parts[0]
 	/* Usage */
-	if nil == net.ParseIP(addr) {
+	if nil == net.ParseIP(addr) || 2 < len(parts) {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(
-			"No IP address specified.  The last element of the " +
-				"URL must be an IP address.",
+			"No IP address specified.  The URL must end in " +
+				"/res/<address> or /res/<address>/<id>.json " +
+				"or /res/<address>/<id>.sig.",
 		))
+		return
 	}
-	/* Last scan result */
-	res, err := lastRes(addr)
-	if err != nil {
+	/* Make sure the requestor may see it */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
 		w.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(w, err.Error())
 		return
 	}
-
-	/* Requestor's IP */
-	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if !reqCanSee(req, rip, addr) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, hiddenMessage(addr))
+		debug("%v refused report for %v", rip, addr)
+		return
+	}
+	/* Signed reports and signatures for a particular scan */
+	if 2 == len(parts) {
+		id, ext := parts[1], ""
+		if i := strings.LastIndex(id, "."); -1 != i {
+			id, ext = id[:i], id[i+1:]
+		}
+		sendScanFile(w, req, addr, id, ext)
+		return
+	}
+	/* Work out how to send it */
+	f, code, err := negotiateFormat(req)
 	if nil != err {
+		formatFail(w, FORMATTEXT, code, "%v", err)
+		return
+	}
+	if FORMATHTML != f {
+		queryFormatted(w, req, addr, f)
+		return
+	}
+
+	/* Last scan result */
+	res, err := lastRes(addr)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(w, err.Error())
 		return
 	}
 
+	setFormatHeaders(w, f)
+
 	/* No result */
 	if nil == res {
 		io.WriteString(w, fmt.Sprintf("No scan results for %v", addr))
-		debug("%v sent no report for %v", ip, addr)
+		debug("%v sent no report for %v", rip, addr)
 		return
 	}
 
 	/* Send result */
-	if _, err := w.Write([]byte(fmt.Sprintf(`<!DOCTYPE HTML>
-<HEAD>
-	<TITLE>CGIS:%v</TITLE>
-	<STYLE TYPE="text/css"><!--
-		body {
-			background-color: white;
-			color: black;
-			font-family: 'Comic Sans MS', 'Chalkboard SE', 'Comic Neue', sans-serif;
+	page := resultPage{
+		Addr:     addr,
+		Report:   string(res),
+		Signed:   nil != SIGKEY,
+		ViewPath: viewPath(req),
+	}
+	if page.Annotation, err = getAnnotation(addr); nil != err {
+		page.AnnotationError = err.Error()
+	}
+	if page.Signed {
+		rs, err := STORE.History(addr)
+		if nil != err {
+			page.HistoryError = err.Error()
+		}
+		/* Newest first */
+		for i := len(rs) - 1; 0 <= i; i-- {
+			page.History = append(page.History, rs[i])
 		}
-	--></STYLE>
-</HEAD>
-<BODY>
-<H1>Scan Result for %v</H1>
-<PRE>
-`, addr, addr))); nil != err {
+	}
+	if err := renderPage(w, "result.html", page); nil != err {
+		return
+	}
+	debug("%v sent report for %v", rip, addr)
+}
+
+/* resultPage is what's needed to render a result page.  History is only
+filled in if reports are signed. */
+type resultPage struct {
+	Addr            string
+	Report          string
+	Annotation      *annotation
+	AnnotationError string
+	Signed          bool
+	History         []*result
+	HistoryError    string
+	ViewPath        string /* From viewPath */
+}
+
+/* queryFormatted sends the last scan result for a in format f, which must
+not be FORMATHTML */
+func queryFormatted(w http.ResponseWriter, req *http.Request, a, f string) {
+	/* Requestor's IP */
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		formatFail(w, f, http.StatusInternalServerError, "%v", err)
 		return
 	}
-	if _, err := w.Write(res); nil != err {
+
+	/* Last scan result and annotation */
+	r, err := STORE.Get(a)
+	if nil != err {
+		formatFail(w, f, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if nil == r {
+		formatFail(w, f, http.StatusNotFound, "No scan results for %v", a)
+		debug("%v sent no %v report for %v", ip, f, a)
+		return
+	}
+	an, err := getAnnotation(a)
+	if nil != err {
+		formatFail(w, f, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	setFormatHeaders(w, f)
+	if err := writeResult(w, f, r, an); nil != err {
+		debug("%v error sending %v report for %v: %v", ip, f, a, err)
 		return
 	}
-	io.WriteString(w, "\n</PRE>\n</BODY>\n<HTML>\n")
-	debug("%v sent report for %v", ip, addr)
+	debug("%v sent %v report for %v", ip, f, a)
 }
 
-/* lastRes gets the last results for the scanned IP */
+/* lastRes gets the report from the last results for the scanned IP */
 func lastRes(ip string) ([]byte, error) {
-	var res []byte /* Scan results */
-	err := DB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(RESBUCKET))
-		value := bucket.Get([]byte(ip))
-		/* Return nil if there's no previous scan */
-		if nil == value {
-			return nil
-		}
-		/* Copy the data to a returnable slice */
-		res = make([]byte, len(value))
-		copy(res, value)
-		return nil
-	})
-	return res, err
+	r, err := STORE.Get(ip)
+	/* Return nil if there's no previous scan */
+	if nil != err || nil == r {
+		return nil, err
+	}
+	return r.Report(), nil
 }
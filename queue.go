@@ -2,25 +2,25 @@ package main
 
 /*
  * queue.go
- * Return the queue
+ * Return and persist the queue
  * By J. Stuart McMurray
  * Created 20160706
- * Last Modified 20160706
+ * Last Modified 20261018
  */
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
+	"sort"
 	"time"
 )
 
 /* sendQueue returns the queue to the requestor */
 func sendQueue(w http.ResponseWriter, req *http.Request) {
-	QLOCK.Lock()
-	defer QLOCK.Unlock()
-
 	/* Get the requestor's address */
 	rip, _, err := net.SplitHostPort(req.RemoteAddr)
 	if nil != err {
@@ -29,86 +29,201 @@ func sendQueue(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	/* Get IPs being scanned */
-	ss := make([]qaddr, 0, len(SCANNING))
-	for k, v := range SCANNING {
-		ss = append(ss, qaddr{a: k, t: v})
-	}
-
-	/* Copy the IPs in the queue, to keep the locking short */
-	qs := make([]qaddr, 0, QUEUE.Len())
-	for e := QUEUE.Front(); nil != e; e = e.Next() {
-		qs = append(qs, e.Value.(qaddr))
-	}
+	/* Get IPs being scanned and queued */
+	ss, qs := queueSnapshot()
 
 	/* Send queue to the user */
-	if _, err := io.WriteString(w, `<!DOCTYPE HTML>
-<HEAD>
-	<TITLE>CGIScan Queue</TITLE>
-	<STYLE TYPE="text/css"><!--
-		body {
-			background-color: white;
-			color: black;
-			font-family: 'Comic Sans MS', 'Chalkboard SE', 'Comic Neue', sans-serif;
-		}
-	--></STYLE>
-</HEAD>
-<BODY>
-`); nil != err {
+	if err := renderPage(w, "queue.html", struct {
+		Scanning []apiQaddr
+		Queued   []apiQaddr
+	}{apiQaddrs(rip, ss), apiQaddrs(rip, qs)}); nil != err {
 		return
 	}
 
-	/* Send hosts being scanned */
-	if _, err := io.WriteString(w, "<H1>Currently Being Scanned</H1>\n<P>\n"); nil != err {
-		return
-	}
-	/* Note if it's empty */
-	if 0 == len(ss) {
-		if _, err := io.WriteString(w, "None.\n"); nil != err {
+	debug("%v sent queue", rip)
+
+}
+
+/* adminQueue sends back the addresses being scanned and in the queue as
+JSON, in full.  If the request is a POST or DELETE, the address in the address
+parameter is first removed from the queue. */
+func adminQueue(w http.ResponseWriter, req *http.Request) {
+	/* Remove an address, if we're meant to */
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodDelete:
+		ip := net.ParseIP(req.FormValue("address"))
+		if nil == ip {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Invalid or missing address.")
 			return
 		}
-	}
-	for _, s := range ss {
-		if err := writeQaddr(w, s); nil != err {
+		a := ip.String()
+		ok, err := unqueue(a)
+		if nil != err {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			log.Printf(
+				"%v Error removing %v from the queue: %v",
+				adminWho(req),
+				a,
+				err,
+			)
 			return
 		}
-	}
-
-	/* Send Queue */
-	if _, err := io.WriteString(w, "</P>\n<H1>Scan Queue</H1>\n<P>\n"); nil != err {
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, fmt.Sprintf(
+				"%v isn't waiting in the queue.\n",
+				a,
+			))
+			return
+		}
+		log.Printf("%v Removed %v from the queue", adminWho(req), a)
+	default:
+		w.Header().Set("Allow", "DELETE, GET, HEAD, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	/* Note if it's empty */
-	if 0 == len(qs) {
-		if _, err := io.WriteString(w, "None.\n"); nil != err {
-			return
+
+	/* Send back what's left */
+	ss, qs := queueSnapshot()
+	full := func(qas []qaddr) []apiQaddr {
+		as := make([]apiQaddr, len(qas))
+		for i, q := range qas {
+			as[i] = apiQaddr{Addr: q.a, Since: q.t}
 		}
+		return as
 	}
-	for _, q := range qs {
-		if err := writeQaddr(w, q); nil != err {
-			return
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Scanning []apiQaddr `json:"scanning"`
+		Queued   []apiQaddr `json:"queued"`
+	}{full(ss), full(qs)})
+}
+
+/* unqueue removes a from the queue, if it's waiting there.  Addresses being
+scanned aren't removed.  It returns false if a wasn't in the queue. */
+func unqueue(a string) (bool, error) {
+	QLOCK.Lock()
+	defer QLOCK.Unlock()
+	for e := QUEUE.Front(); nil != e; e = e.Next() {
+		q := e.Value.(qaddr)
+		if q.a != a {
+			continue
 		}
+		QUEUE.Remove(e)
+		publish(a, "state", eventState{
+			apiState:    apiState{Addr: a, State: STATEIDLE},
+			QueueLength: QUEUE.Len(),
+		})
+		publishQueuePositions()
+		return true, forgetQaddr(q)
+	}
+	return false, nil
+}
+
+/* queueSnapshot returns copies of the addresses being scanned and the
+addresses in the queue, to keep the locking short */
+func queueSnapshot() (scanning, queued []qaddr) {
+	QLOCK.Lock()
+	defer QLOCK.Unlock()
+
+	/* Get IPs being scanned */
+	scanning = make([]qaddr, 0, len(SCANNING))
+	for k, v := range SCANNING {
+		scanning = append(scanning, qaddr{a: k, t: v})
 	}
+	sort.Slice(scanning, func(i, j int) bool {
+		return scanning[i].t.Before(scanning[j].t)
+	})
 
-	/* Close document */
-	if _, err := io.WriteString(w, "</P>\n</BODY>\n</HEAD>\n"); nil != err {
-		return
+	/* Copy the IPs in the queue */
+	queued = make([]qaddr, 0, QUEUE.Len())
+	for e := QUEUE.Front(); nil != e; e = e.Next() {
+		queued = append(queued, e.Value.(qaddr))
 	}
 
-	debug("%v sent queue", rip)
+	return scanning, queued
+}
+
+/* apiQaddrs converts qas to apiQaddrs, with the addresses as the requestor
+at rip may see them */
+func apiQaddrs(rip string, qas []qaddr) []apiQaddr {
+	as := make([]apiQaddr, len(qas))
+	for i, q := range qas {
+		as[i] = apiQaddr{Since: q.t}
+		as[i].Addr, as[i].Link = shownAddr(rip, q.a)
+	}
+	return as
+}
+
+/* QUEUEBUCKET holds the queued and in-progress addresses, keyed by qaddr.key
+so they sort in the order they were queued */
+const QUEUEBUCKET = "Queue"
 
+/* storedQaddr is how a qaddr is stored in QUEUEBUCKET */
+type storedQaddr struct {
+	Addr string    `json:"address"`
+	Time time.Time `json:"time"`
 }
 
-/* writeQaddr writes the queued qaddr q to w */
-func writeQaddr(w io.Writer, q qaddr) error {
-	if _, err := w.Write([]byte(fmt.Sprintf(
-		"%v <A HREF=\"%v/res/%v\">%v</A><BR>\n",
-		q.t.Format(time.RFC3339),
-		URLPATH,
-		q.a,
-		q.a,
-	))); nil != err {
+/* key returns q's key in QUEUEBUCKET */
+func (q qaddr) key() string {
+	return fmt.Sprintf("%016x-%v", q.t.UnixNano(), q.a)
+}
+
+/* saveQaddr stores q in QUEUEBUCKET, to survive restarts */
+func saveQaddr(q qaddr) error {
+	v, err := json.Marshal(storedQaddr{Addr: q.a, Time: q.t})
+	if nil != err {
 		return err
 	}
+	return STORE.PutKV(QUEUEBUCKET, q.key(), v)
+}
+
+/* forgetQaddr removes q from QUEUEBUCKET once it's been scanned */
+func forgetQaddr(q qaddr) error { return STORE.DeleteKV(QUEUEBUCKET, q.key()) }
+
+/* restoreQueue puts the addresses in QUEUEBUCKET back in the queue, in the
+order in which they were originally queued, with their original times.
+Addresses which were being scanned when cgiscan stopped will be scanned
+again.  It should be called before the scanner is started. */
+func restoreQueue() error {
+	QLOCK.Lock()
+	defer QLOCK.Unlock()
+	var (
+		seen = make(map[string]bool)
+		dups []string
+	)
+	if err := STORE.ForEachKV(QUEUEBUCKET, func(k string, v []byte) error {
+		var sq storedQaddr
+		if err := json.Unmarshal(v, &sq); nil != err {
+			return fmt.Errorf("decoding queue entry %v: %v", k, err)
+		}
+		if seen[sq.Addr] {
+			dups = append(dups, k)
+			return nil
+		}
+		seen[sq.Addr] = true
+		QUEUE.PushBack(qaddr{a: sq.Addr, t: sq.Time})
+		debug("%v Restored to queue, queued %v", sq.Addr, sq.Time)
+		return nil
+	}); nil != err {
+		return err
+	}
+
+	/* Duplicates are removed after iterating, as the Store may not allow
+	changes during ForEachKV. */
+	for _, k := range dups {
+		if err := STORE.DeleteKV(QUEUEBUCKET, k); nil != err {
+			return fmt.Errorf(
+				"removing duplicate queue entry %v: %v",
+				k,
+				err,
+			)
+		}
+		debug("Removed duplicate queue entry %v", k)
+	}
 	return nil
 }
@@ -0,0 +1,200 @@
+package main
+
+/*
+ * result.go
+ * Stored scan results
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/* LEGACYFINISH is the prefix of the line in an old-style plaintext report
+which holds the time the scan finished */
+const LEGACYFINISH = "Scan finished at "
+
+/* result is the stored result of scanning an address */
+type result struct {
+	ID     string    `json:"id"` /* Unique per address */
+	Addr   string    `json:"address"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Ports  []portRes `json:"ports"`
+	Legacy []byte    `json:"legacy,omitempty"` /* Pre-JSON report */
+	/* Signature of the rest of the result, made when it was scanned */
+	Sig []byte `json:"signature,omitempty"`
+}
+
+/* Report returns the human-readable report for r */
+func (r *result) Report() []byte {
+	if nil != r.Legacy {
+		return r.Legacy
+	}
+	return openPortsReport(r)
+}
+
+/* encodeResult turns r into something suitable for storage */
+func encodeResult(r *result) ([]byte, error) { return json.Marshal(r) }
+
+/* decodeResult turns a stored value for address a back into a result.  Values
+stored by older versions of cgiscan were just the text report, which will be
+put in the returned result's Legacy field. */
+func decodeResult(a string, v []byte) (*result, error) {
+	/* Old-style results are a plaintext report */
+	if !bytes.HasPrefix(v, []byte("{")) {
+		return legacyResult(a, v), nil
+	}
+	r := &result{}
+	if err := json.Unmarshal(v, r); nil != err {
+		return nil, err
+	}
+	r.setID()
+	return r, nil
+}
+
+/* legacyResult wraps the plaintext report b for address a in a result,
+extracting the finish time if possible */
+func legacyResult(a string, b []byte) *result {
+	r := &result{Addr: a, Legacy: make([]byte, len(b))}
+	copy(r.Legacy, b)
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(l, LEGACYFINISH) {
+			continue
+		}
+		t, err := time.Parse(
+			time.RFC3339,
+			strings.TrimPrefix(l, LEGACYFINISH),
+		)
+		if nil == err {
+			r.End = t
+		}
+		break
+	}
+	r.setID()
+	return r
+}
+
+/* storeResult saves r in STORE and updates anything kept alongside results,
+such as the latest ports used by searches.  If scanned is true, r has just been
+scanned and is signed, if there's a key; otherwise, it's stored unsigned. */
+func storeResult(r *result, scanned bool) error {
+	r.Sig = nil
+	if scanned && nil != SIGKEY {
+		r.setID()
+		if err := signResult(r); nil != err {
+			return fmt.Errorf("signing: %v", err)
+		}
+	}
+	if err := STORE.Save(r); nil != err {
+		return err
+	}
+	if err := saveListOrder(r); nil != err {
+		return err
+	}
+	return saveLatestPorts(r)
+}
+
+/* removeResult removes a's results from STORE and anything kept alongside
+them, including links to them */
+func removeResult(a string) error {
+	if err := STORE.Delete(a); nil != err {
+		return err
+	}
+	if err := removeShares(a); nil != err {
+		return err
+	}
+	if err := removeListOrder(a); nil != err {
+		return err
+	}
+	return removeLatestPorts(a)
+}
+
+/* resultFilter selects results by address and finish time.  Zero values
+match everything. */
+type resultFilter struct {
+	net   *net.IPNet /* Address range */
+	since time.Time  /* Earliest finish time */
+	until time.Time  /* Finish time before which results must finish */
+}
+
+/* parseResultFilter makes a resultFilter from a CIDR range or address and a
+pair of times, any of which may be the empty string */
+func parseResultFilter(cidr, since, until string) (resultFilter, error) {
+	var (
+		f   resultFilter
+		err error
+	)
+	/* Address range, which may be a bare address */
+	if "" != cidr {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if nil == ip {
+				return f, fmt.Errorf("invalid address %q", cidr)
+			}
+			if nil != ip.To4() {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		if _, f.net, err = net.ParseCIDR(cidr); nil != err {
+			return f, err
+		}
+	}
+	/* Time range */
+	if f.since, err = parseFilterTime(since, false); nil != err {
+		return f, err
+	}
+	if f.until, err = parseFilterTime(until, true); nil != err {
+		return f, err
+	}
+	return f, nil
+}
+
+/* parseFilterTime parses s as either an RFC3339 time or a date.  The empty
+string yields the zero time.  If end is true, the time returned is just after
+the time or date, so a date includes the whole day. */
+func parseFilterTime(s string, end bool) (time.Time, error) {
+	if "" == s {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); nil == err {
+		if end {
+			t = t.Add(time.Nanosecond)
+		}
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if nil != err {
+		return t, fmt.Errorf(
+			"invalid time %q, must be RFC3339 or YYYY-MM-DD",
+			s,
+		)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+/* match returns true if r is selected by f */
+func (f resultFilter) match(r *result) bool {
+	if nil != f.net && !f.net.Contains(net.ParseIP(r.Addr)) {
+		return false
+	}
+	if !f.since.IsZero() && r.End.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !r.End.Before(f.until) {
+		return false
+	}
+	return true
+}
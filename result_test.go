@@ -0,0 +1,74 @@
+package main
+
+/*
+ * result_test.go
+ * Make sure results are filtered by the right times
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResultFilterTimes(t *testing.T) {
+	at := func(s string) *result {
+		e, err := time.Parse(time.RFC3339Nano, s)
+		if nil != err {
+			t.Fatalf("Bad test time %q: %v", s, err)
+		}
+		return &result{Addr: "192.0.2.1", End: e}
+	}
+	for _, c := range []struct {
+		since string
+		until string
+		end   string
+		want  bool
+	}{
+		/* A date-only until covers the whole day */
+		{"", "2026-10-18", "2026-10-18T00:00:00Z", true},
+		{"", "2026-10-18", "2026-10-18T23:59:59.999999999Z", true},
+		{"", "2026-10-18", "2026-10-19T00:00:00Z", false},
+		{"", "2026-10-18", "2026-10-17T12:00:00Z", true},
+		/* A date-only since starts at the start of the day */
+		{"2026-10-18", "", "2026-10-18T00:00:00Z", true},
+		{"2026-10-18", "", "2026-10-17T23:59:59Z", false},
+		/* Full times are inclusive */
+		{"", "2026-10-18T12:00:00Z", "2026-10-18T12:00:00Z", true},
+		{"", "2026-10-18T12:00:00Z", "2026-10-18T12:00:01Z", false},
+		{"2026-10-18T12:00:00Z", "", "2026-10-18T12:00:00Z", true},
+		/* Both */
+		{"2026-10-17", "2026-10-17", "2026-10-17T18:00:00Z", true},
+		{"2026-10-17", "2026-10-17", "2026-10-18T06:00:00Z", false},
+	} {
+		f, err := parseResultFilter("", c.since, c.until)
+		if nil != err {
+			t.Fatalf(
+				"parseResultFilter(%q, %q): %v",
+				c.since,
+				c.until,
+				err,
+			)
+		}
+		if got := f.match(at(c.end)); got != c.want {
+			t.Errorf(
+				"since %q until %q, finished %v: "+
+					"got %v, want %v",
+				c.since,
+				c.until,
+				c.end,
+				got,
+				c.want,
+			)
+		}
+	}
+
+	/* Rubbish isn't a time */
+	for _, s := range []string{"yesterday", "2026-13-01", "18/10/2026"} {
+		if _, err := parseFilterTime(s, true); nil == err {
+			t.Errorf("parseFilterTime(%q) accepted", s)
+		}
+	}
+}
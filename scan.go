@@ -5,7 +5,7 @@ package main
  * Scan a requestor
  * By J. Stuart McMurray
  * Created 20160706
- * Last Modified 20160706
+ * Last Modified 20261018
  */
 
 import (
@@ -20,15 +20,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 /* portRes is the result of scanning an open port */
 type portRes struct {
-	port   int
-	banner []byte
+	Port    int    `json:"port"`
+	Service string `json:"service,omitempty"` /* Best guess */
+	Banner  []byte `json:"banner,omitempty"`
 }
 
 /* qaddr is an address waiting in the queue, with the time it went in */
@@ -50,23 +50,15 @@ var (
 	QCOND    *sync.Cond           /* Notifier for queue adds */
 )
 
-/* Maintain the average time of each scan */
-var (
-	NSCAN   int           /* Number scanned */
-	AVGTIME time.Duration /* Average scan time */
-	AVGLOCK *sync.Mutex   /* Average scan time lock */
-)
-
 func init() {
 	SCANNING = make(map[string]time.Time)
 	QUEUE = list.New()
 	QLOCK = &sync.Mutex{}
 	QCOND = sync.NewCond(QLOCK)
-	AVGLOCK = &sync.Mutex{}
 }
 
 /* scan Scans an IP address */
-func scan(a string, nAttempt uint, start time.Time) []byte {
+func scan(a string, nAttempt uint, start time.Time) *result {
 	debug("%v Scanning", a)
 	/* Open ports */
 	var successes = make(map[int][]byte)
@@ -83,6 +75,7 @@ func scan(a string, nAttempt uint, start time.Time) []byte {
 	/* Send ports to scanners */
 	for i := 1; i <= 65535; i++ {
 		ps <- i
+		scannerBeat(false)
 		if 0 == i%10000 {
 			debug(
 				"%v Queued port %v (%v)",
@@ -98,7 +91,16 @@ func scan(a string, nAttempt uint, start time.Time) []byte {
 	sdone := make(chan struct{})
 	go func() {
 		for o := range os {
-			successes[o.port] = o.banner
+			successes[o.Port] = o.Banner
+			atomic.AddUint64(&METRICOPENPORTS, 1)
+			if !canSee(a, a) {
+				continue
+			}
+			publish(a, "port", eventPort{
+				Port:    o.Port,
+				Service: guessService(o.Port, o.Banner),
+				Banner:  quoteBanner(o.Banner),
+			})
 		}
 		close(sdone)
 	}()
@@ -113,11 +115,25 @@ func scan(a string, nAttempt uint, start time.Time) []byte {
 	sd := time.Now().Sub(start) /* Scan duration */
 	debug("%v Scanned in %v", a, sd)
 
-	/* Maintain averages */
-	updateAverages(sd)
-
 	/* Craft and return result */
-	return openPortsReport(successes, start)
+	r := &result{
+		ID:    newScanID(start),
+		Addr:  a,
+		Start: start,
+		End:   time.Now(),
+		Ports: make([]portRes, 0, len(successes)),
+	}
+	for p, b := range successes {
+		r.Ports = append(r.Ports, portRes{
+			Port:    p,
+			Banner:  b,
+			Service: guessService(p, b),
+		})
+	}
+	sort.Slice(r.Ports, func(i, j int) bool {
+		return r.Ports[i].Port < r.Ports[j].Port
+	})
+	return r
 }
 
 /* scanPort scans the ports on a it gets from ps, and reports to os */
@@ -131,6 +147,7 @@ func scanPorts(a string, ps <-chan int, os chan<- portRes, wg *sync.WaitGroup) {
 	try:
 		/* Attack the single port */
 		b, err = tryPort(a, p)
+		countConnection(err)
 		if nil != err {
 			/* This means we're trying too hard, retry in a bit */
 			if strings.HasSuffix(
@@ -144,7 +161,7 @@ func scanPorts(a string, ps <-chan int, os chan<- portRes, wg *sync.WaitGroup) {
 			continue
 		}
 		/* Port's open, return the banner */
-		os <- portRes{port: p, banner: b}
+		os <- portRes{Port: p, Banner: b}
 	}
 }
 
@@ -175,51 +192,69 @@ func tryPort(a string, p int) ([]byte, error) {
 	return b, nil
 }
 
-/* openPortsReport makes a nice report from the set of open ports and the
-start time of the scan. */
-func openPortsReport(m map[int][]byte, start time.Time) []byte {
+/* openPortsReport makes a nice report from the open ports in a scan
+result. */
+func openPortsReport(r *result) []byte {
 	/* Report to be returned */
 	report := &bytes.Buffer{}
 	fmt.Fprintf(
 		report,
-		"Scan finished at %v\n\n",
-		time.Now().UTC().Format(time.RFC3339),
+		"%v%v\n\n",
+		LEGACYFINISH,
+		r.End.UTC().Format(time.RFC3339),
 	)
 
 	/* No ports is an easy case */
-	if 0 == len(m) {
+	if 0 == len(r.Ports) {
 		fmt.Fprintf(report, "No ports open.\n\n")
 		return report.Bytes()
 	}
 
-	/* Sorted open ports list */
-	os := make([]int, 0, len(m))
-	for k := range m {
-		os = append(os, k)
-	}
-	sort.Ints(os)
-
 	/* Header */
-	fmt.Fprintf(report, "Port   | Banner\n")
-	fmt.Fprintf(report, "-------+-------\n")
+	fmt.Fprintf(report, "Port   | Service         | Banner\n")
+	fmt.Fprintf(report, "-------+-----------------+-------\n")
 
 	/* Add each port to the list */
-	for _, o := range os {
+	for _, o := range r.Ports {
 		var banner string
 		/* Print banner */
-		if nil == m[o] || 0 == len(m[o]) {
+		if nil == o.Banner || 0 == len(o.Banner) {
 			banner = "None"
 		} else {
-			banner = fmt.Sprintf("%q", m[o])
+			banner = fmt.Sprintf("%q", o.Banner)
 		}
 		/* Add to report */
-		fmt.Fprintf(report, "%-6v | %v\n", o, banner)
+		fmt.Fprintf(
+			report,
+			"%-6v | %-15v | %v\n",
+			o.Port,
+			reportService(o),
+			banner,
+		)
 	}
 
 	return report.Bytes()
 }
 
-/* handle handles incoming scan requests */
+/* quoteBanner returns b as a Go string literal, without the quotes */
+func quoteBanner(b []byte) string {
+	return strings.Trim(fmt.Sprintf("%q", b), `"`)
+}
+
+/* reportService returns the service to report for p.  Older results won't
+have a service, so one is guessed. */
+func reportService(p portRes) string {
+	if "" != p.Service {
+		return p.Service
+	}
+	if s := guessService(p.Port, p.Banner); "" != s {
+		return s
+	}
+	return "unknown"
+}
+
+/* handle handles incoming scan requests.  Scans are only queued for POSTs
+with a CSRF token; GETs get a form to confirm the scan. */
 func handleScan(w http.ResponseWriter, req *http.Request) {
 	/* Get the requestor's address */
 	ip, _, err := net.SplitHostPort(req.RemoteAddr)
@@ -229,6 +264,15 @@ func handleScan(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	/* Make sure the requestor really meant it */
+	if !confirmOrCheck(w, req, ip, "/scan", confirmPage{
+		Title:  "Scan",
+		Prompt: fmt.Sprintf("Scan %v?", ip),
+		Button: "Scan",
+	}) {
+		return
+	}
+
 	/* Queue it up */
 	enqueue(ip)
 
@@ -239,6 +283,9 @@ func handleScan(w http.ResponseWriter, req *http.Request) {
 /* enqueue adds the address to the scan queue if it's not already there (or
 being scanned */
 func enqueue(a string) {
+	QLOCK.Lock()
+	defer QLOCK.Unlock()
+
 	/* Make sure we're not currently scanning */
 	if _, ok := SCANNING[a]; ok {
 		debug("%v Being scanned", a)
@@ -257,30 +304,47 @@ func enqueue(a string) {
 	}
 	/* Add to the list */
 	/* This whole thing should probably be replaced by a circular buffer */
-	/* Enqueue */
-	QUEUE.PushBack(newQaddr(a))
+	/* Enqueue, and remember it in case we restart */
+	q := newQaddr(a)
+	QUEUE.PushBack(q)
+	if err := saveQaddr(q); nil != err {
+		log.Printf("Error saving queued address %v: %v", a, err)
+	}
 	/* Wake up a goroutine if one's waiting */
 	QCOND.Signal()
+	publishQueuePositions()
 	debug("%v Queued", a)
 }
 
 /* scanner pops an IP off the queue and scans it */
 func scanner(nAttempt uint) {
 	debug("Scanner started")
+	scannerBeat(false)
 	for {
 		/* Wait for something to be enqueued */
 		QLOCK.Lock()
 		for 0 == QUEUE.Len() {
 			debug("Scanner sleeping")
+			scannerBeat(true)
 			QCOND.Wait()
 			debug("Scanner woke up")
 		}
+		scannerBeat(false)
 
 		/* Pop off the first address */
 		a := QUEUE.Front().Value.(qaddr)
 		start := time.Now()
 		SCANNING[a.a] = start
 		QUEUE.Remove(QUEUE.Front())
+		publish(a.a, "state", eventState{
+			apiState: apiState{
+				Addr:  a.a,
+				State: STATESCANNING,
+				Since: &start,
+			},
+			QueueLength: QUEUE.Len(),
+		})
+		publishQueuePositions()
 		QLOCK.Unlock()
 
 		/* Scan it */
@@ -289,21 +353,26 @@ func scanner(nAttempt uint) {
 		/* Update database and state */
 		QLOCK.Lock()
 		delete(SCANNING, a.a)
-		if err := DB.Update(func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte(RESBUCKET))
-			return bucket.Put([]byte(a.a), res)
-		}); err != nil {
+		err := storeResult(res, true)
+		if err != nil {
 			log.Printf("Error saving result for %v: %v", a, err)
 		}
+		noteSave(err)
+		countScan(res, nil == err)
+		if err := forgetQaddr(a); nil != err {
+			log.Printf("Error unqueueing %v: %v", a.a, err)
+		}
 		QLOCK.Unlock()
-	}
-}
+		done := eventDone{ID: res.ID, Addr: res.Addr, End: res.End}
+		if canSee(a.a, a.a) {
+			n := len(res.Ports)
+			done.OpenPorts = &n
+		}
+		publish(a.a, "done", done)
 
-/* updateAverages updates the average time a scan takes */
-func updateAverages(sd time.Duration) {
-	AVGLOCK.Lock()
-	defer AVGLOCK.Unlock()
-	AVGTIME = ((AVGTIME * time.Duration(NSCAN)) + sd) /
-		time.Duration(NSCAN+1)
-	NSCAN++
+		/* Maintain statistics */
+		if err := recordStats(res); nil != err {
+			log.Printf("Error saving statistics for %v: %v", a, err)
+		}
+	}
 }
@@ -0,0 +1,684 @@
+package main
+
+/*
+ * search.go
+ * Search banners and services
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* LATESTPORTSBUCKET holds the open ports, with services and banners, from
+the latest result for each address, keyed by address.  Banner searches without
+a port read all of it, as banners aren't indexed. */
+const LATESTPORTSBUCKET = "LatestPorts"
+
+/* SEARCHINDEXBUCKET indexes the ports in LATESTPORTSBUCKET by port and by
+service, so searches for either only read what matches.  Its keys are
+
+port/<port>/<address>              The open port, as JSON
+service/<service>/<address>/<port> The open port, as JSON
+services/<service>                 How many open ports have the service
+
+Ports are zero-padded to five digits, and services are path-escaped. */
+const SEARCHINDEXBUCKET = "SearchIndex"
+
+/* SEARCHINDEXLOCK keeps updates to LATESTPORTSBUCKET and SEARCHINDEXBUCKET
+from interleaving */
+var SEARCHINDEXLOCK = &sync.Mutex{}
+
+/* Fields which may be searched */
+const (
+	SEARCHBANNER  = "banner"
+	SEARCHSERVICE = "service"
+)
+
+/* searchQuery is what to search for in the latest open ports */
+type searchQuery struct {
+	sub   []byte         /* Lowercase substring */
+	re    *regexp.Regexp /* Regex, if sub is nil */
+	field string         /* SEARCHBANNER, SEARCHSERVICE, or "" for both */
+	port  int            /* Port, or 0 for any */
+}
+
+/* searchHit is an open port matched by a search */
+type searchHit struct {
+	Addr string
+	Link bool /* Requestor may see Addr's results */
+	portRes
+}
+
+/* saveLatestPorts replaces the latest open ports for r's address with r's
+ports, and updates the index to match */
+func saveLatestPorts(r *result) error {
+	ps := make([]portRes, len(r.Ports))
+	for i, p := range r.Ports {
+		ps[i] = p
+		if "" == ps[i].Service {
+			ps[i].Service = guessService(p.Port, p.Banner)
+		}
+	}
+	v, err := json.Marshal(ps)
+	if nil != err {
+		return err
+	}
+
+	SEARCHINDEXLOCK.Lock()
+	defer SEARCHINDEXLOCK.Unlock()
+	if err := unindexLatestPorts(r.Addr); nil != err {
+		return err
+	}
+	for _, p := range ps {
+		if err := indexPort(r.Addr, p); nil != err {
+			return err
+		}
+	}
+	return STORE.PutKV(LATESTPORTSBUCKET, r.Addr, v)
+}
+
+/* removeLatestPorts removes a's latest open ports and their index entries */
+func removeLatestPorts(a string) error {
+	SEARCHINDEXLOCK.Lock()
+	defer SEARCHINDEXLOCK.Unlock()
+	if err := unindexLatestPorts(a); nil != err {
+		return err
+	}
+	return STORE.DeleteKV(LATESTPORTSBUCKET, a)
+}
+
+/* unindexLatestPorts removes the index entries for a's latest open ports.
+The caller must hold SEARCHINDEXLOCK. */
+func unindexLatestPorts(a string) error {
+	v, err := STORE.GetKV(LATESTPORTSBUCKET, a)
+	if nil != err || nil == v {
+		return err
+	}
+	var ps []portRes
+	if err := json.Unmarshal(v, &ps); nil != err {
+		return fmt.Errorf("decoding ports for %v: %v", a, err)
+	}
+	for _, p := range ps {
+		pk, sk := indexKeys(a, p)
+		if err := STORE.DeleteKV(SEARCHINDEXBUCKET, pk); nil != err {
+			return err
+		}
+		if err := STORE.DeleteKV(SEARCHINDEXBUCKET, sk); nil != err {
+			return err
+		}
+		if err := countService(p.Service, -1); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* indexPort adds a's open port p to the index.  The caller must hold
+SEARCHINDEXLOCK. */
+func indexPort(a string, p portRes) error {
+	v, err := json.Marshal(p)
+	if nil != err {
+		return err
+	}
+	pk, sk := indexKeys(a, p)
+	if err := STORE.PutKV(SEARCHINDEXBUCKET, pk, v); nil != err {
+		return err
+	}
+	if err := STORE.PutKV(SEARCHINDEXBUCKET, sk, v); nil != err {
+		return err
+	}
+	return countService(p.Service, 1)
+}
+
+/* indexKeys returns the port and service index keys for a's open port p */
+func indexKeys(a string, p portRes) (portKey, serviceKey string) {
+	return fmt.Sprintf("%v%v", portPrefix(p.Port), a),
+		fmt.Sprintf("%v%v/%05d", servicePrefix(p.Service), a, p.Port)
+}
+
+/* portPrefix returns the prefix of the index keys for port p */
+func portPrefix(p int) string { return fmt.Sprintf("port/%05d/", p) }
+
+/* servicePrefix returns the prefix of the index keys for service s */
+func servicePrefix(s string) string {
+	return "service/" + url.PathEscape(s) + "/"
+}
+
+/* countService adds d to the number of open ports with the service s,
+removing the count if it reaches zero.  The caller must hold
+SEARCHINDEXLOCK. */
+func countService(s string, d int) error {
+	k := "services/" + url.PathEscape(s)
+	v, err := STORE.GetKV(SEARCHINDEXBUCKET, k)
+	if nil != err {
+		return err
+	}
+	var n int
+	if nil != v {
+		if n, err = strconv.Atoi(string(v)); nil != err {
+			return fmt.Errorf(
+				"bad count for service %q: %v",
+				s,
+				err,
+			)
+		}
+	}
+	if n += d; 0 >= n {
+		return STORE.DeleteKV(SEARCHINDEXBUCKET, k)
+	}
+	return STORE.PutKV(SEARCHINDEXBUCKET, k, []byte(strconv.Itoa(n)))
+}
+
+/* forEachIndexed calls f with the rest of the key and the value of every
+index entry whose key starts with prefix, in key order, until f returns an
+error.  f must not use STORE. */
+func forEachIndexed(prefix string, f func(rest string, v []byte) error) error {
+	return STORE.ForEachKVFrom(
+		SEARCHINDEXBUCKET,
+		prefix,
+		false,
+		func(k string, v []byte) error {
+			if !strings.HasPrefix(k, prefix) {
+				return ERRSTOPWALK
+			}
+			return f(strings.TrimPrefix(k, prefix), v)
+		},
+	)
+}
+
+/* portHits returns every address with the port p open, in address order */
+func portHits(p int) ([]searchHit, error) {
+	var hits []searchHit
+	err := forEachIndexed(portPrefix(p), func(a string, v []byte) error {
+		h := searchHit{Addr: a}
+		if err := json.Unmarshal(v, &h.portRes); nil != err {
+			return fmt.Errorf(
+				"decoding port %v for %v: %v",
+				p,
+				a,
+				err,
+			)
+		}
+		hits = append(hits, h)
+		return nil
+	})
+	return hits, err
+}
+
+/* serviceHits returns every open port whose service matches sq, in address
+and then port order.  Only the ports with matching services are read. */
+func serviceHits(sq searchQuery) ([]searchHit, error) {
+	/* Work out which services match */
+	var ss []string
+	if err := forEachIndexed(
+		"services/",
+		func(es string, v []byte) error {
+			s, err := url.PathUnescape(es)
+			if nil != err {
+				return fmt.Errorf("bad service %q: %v", es, err)
+			}
+			if sq.matchBytes([]byte(s)) {
+				ss = append(ss, s)
+			}
+			return nil
+		},
+	); nil != err {
+		return nil, err
+	}
+
+	/* Get their ports */
+	var hits []searchHit
+	for _, s := range ss {
+		if err := forEachIndexed(
+			servicePrefix(s),
+			func(rest string, v []byte) error {
+				h := searchHit{}
+				if i := strings.LastIndex(rest, "/"); -1 != i {
+					h.Addr = rest[:i]
+				}
+				if err := json.Unmarshal(
+					v,
+					&h.portRes,
+				); nil != err {
+					return fmt.Errorf(
+						"decoding %v: %v",
+						rest,
+						err,
+					)
+				}
+				hits = append(hits, h)
+				return nil
+			},
+		); nil != err {
+			return nil, err
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Addr != hits[j].Addr {
+			return hits[i].Addr < hits[j].Addr
+		}
+		return hits[i].Port < hits[j].Port
+	})
+	return hits, nil
+}
+
+/* fillLatestPorts saves the latest open ports for any addresses which don't
+have them saved, such as those scanned by older versions of cgiscan */
+func fillLatestPorts() error {
+	/* Work out what's been saved */
+	saved := make(map[string]bool)
+	if err := STORE.ForEachKV(
+		LATESTPORTSBUCKET,
+		func(k string, v []byte) error {
+			saved[k] = true
+			return nil
+		},
+	); nil != err {
+		return err
+	}
+
+	/* Get the results which haven't been */
+	var rs []*result
+	if err := STORE.List(func(r *result) error {
+		if !saved[r.Addr] {
+			rs = append(rs, r)
+		}
+		return nil
+	}); nil != err {
+		return err
+	}
+
+	/* Save them */
+	for _, r := range rs {
+		if err := saveLatestPorts(r); nil != err {
+			return fmt.Errorf("saving %v's ports: %v", r.Addr, err)
+		}
+	}
+	if 0 != len(rs) {
+		log.Printf("Saved latest ports for %v results", len(rs))
+	}
+	return nil
+}
+
+/* parseSearchQuery makes a searchQuery from a substring or regex, a field,
+and a port.  Only one of sub and re may be set, and field and port may be
+the empty string. */
+func parseSearchQuery(sub, re, field, port string) (searchQuery, error) {
+	var sq searchQuery
+
+	/* What we're looking for */
+	switch {
+	case "" != sub && "" != re:
+		return sq, fmt.Errorf("only one of a substring or regex " +
+			"may be given")
+	case "" != sub:
+		sq.sub = bytes.ToLower([]byte(sub))
+	case "" != re:
+		var err error
+		if sq.re, err = regexp.Compile(re); nil != err {
+			return sq, err
+		}
+	default:
+		return sq, fmt.Errorf("need a substring or regex")
+	}
+
+	/* Where we're looking */
+	switch field {
+	case "", SEARCHBANNER, SEARCHSERVICE:
+		sq.field = field
+	default:
+		return sq, fmt.Errorf(
+			"field must be %q or %q",
+			SEARCHBANNER,
+			SEARCHSERVICE,
+		)
+	}
+	if "" != port {
+		var err error
+		sq.port, err = strconv.Atoi(port)
+		if nil != err || 1 > sq.port || 65535 < sq.port {
+			return sq, fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	return sq, nil
+}
+
+/* matchBytes returns true if b matches sq's substring or regex */
+func (sq searchQuery) matchBytes(b []byte) bool {
+	if nil != sq.re {
+		return sq.re.Match(b)
+	}
+	return bytes.Contains(bytes.ToLower(b), sq.sub)
+}
+
+/* match returns true if p matches sq */
+func (sq searchQuery) match(p portRes) bool {
+	if 0 != sq.port && p.Port != sq.port {
+		return false
+	}
+	switch sq.field {
+	case SEARCHBANNER:
+		return sq.matchBytes(p.Banner)
+	case SEARCHSERVICE:
+		return sq.matchBytes([]byte(p.Service))
+	default:
+		return sq.matchBytes(p.Banner) ||
+			sq.matchBytes([]byte(p.Service))
+	}
+}
+
+/* forEachLatestPort calls f on every address' latest open ports, in address
+and then port order, until f returns an error.  f must not use STORE. */
+func forEachLatestPort(f func(a string, p portRes) error) error {
+	return STORE.ForEachKV(
+		LATESTPORTSBUCKET,
+		func(k string, v []byte) error {
+			var ps []portRes
+			if err := json.Unmarshal(v, &ps); nil != err {
+				return fmt.Errorf(
+					"decoding ports for %v: %v",
+					k,
+					err,
+				)
+			}
+			for _, p := range ps {
+				if err := f(k, p); nil != err {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+}
+
+/* search returns the latest open ports which match sq, in address and then
+port order.  Searches for a port or only for services use the index; others
+have to read every open port's banner. */
+func search(sq searchQuery) ([]searchHit, error) {
+	var (
+		hits []searchHit
+		err  error
+	)
+	switch {
+	case 0 != sq.port:
+		hits, err = portHits(sq.port)
+	case SEARCHSERVICE == sq.field:
+		return serviceHits(sq)
+	default:
+		err = forEachLatestPort(func(a string, p portRes) error {
+			hits = append(hits, searchHit{Addr: a, portRes: p})
+			return nil
+		})
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	/* Keep the matches */
+	var mhs []searchHit
+	for _, h := range hits {
+		if sq.match(h.portRes) {
+			mhs = append(mhs, h)
+		}
+	}
+	return mhs, nil
+}
+
+/* visibleHits returns the hits whose results, which include the banners, the
+maker of req, at rip, may see, with their addresses as the requestor may see
+them */
+func visibleHits(req *http.Request, rip string, hits []searchHit) []searchHit {
+	var lhs []searchHit
+	for _, h := range hits {
+		if !reqCanSee(req, rip, h.Addr) {
+			continue
+		}
+		if isAdmin(req) {
+			h.Link = true
+		} else {
+			h.Addr, h.Link = shownAddr(rip, h.Addr)
+		}
+		lhs = append(lhs, h)
+	}
+	return lhs
+}
+
+/* searchFromRequest runs the search given by req's q, re, field, and port
+query parameters */
+func searchFromRequest(req *http.Request) ([]searchHit, error) {
+	q := req.URL.Query()
+	sq, err := parseSearchQuery(
+		q.Get("q"),
+		q.Get("re"),
+		q.Get("field"),
+		q.Get("port"),
+	)
+	if nil != err {
+		return nil, err
+	}
+	return search(sq)
+}
+
+/* handleSearch sends back a search form, and the results of the search, if
+one was requested */
+func handleSearch(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Search, if we've something for which to search */
+	var (
+		hits []searchHit
+		serr error
+		q    = req.URL.Query()
+	)
+	searched := "" != q.Get("q") || "" != q.Get("re")
+	if searched {
+		hits, serr = searchFromRequest(req)
+		if nil != serr {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+
+	/* Send the form and results */
+	page := searchPage{
+		Q:        q.Get("q"),
+		Re:       q.Get("re"),
+		Field:    q.Get("field"),
+		Port:     q.Get("port"),
+		Searched: searched,
+		Hits:     visibleHits(req, rip, hits),
+		ViewPath: viewPath(req),
+	}
+	if nil != serr {
+		page.Error = serr.Error()
+	}
+	if err := renderPage(w, "search.html", page); nil != err {
+		return
+	}
+
+	if searched {
+		debug("%v Searched for %q, %v hits", rip, q.Encode(), len(hits))
+	}
+}
+
+/* searchPage is what's needed to render the search page */
+type searchPage struct {
+	Q        string
+	Re       string
+	Field    string
+	Port     string
+	Searched bool
+	Error    string
+	Hits     []searchHit
+	ViewPath string /* From viewPath */
+}
+
+/* adminSearch sends back the results of a search as plain text, one hit per
+line, or to browsers as the search page, with every hit linked */
+func adminSearch(w http.ResponseWriter, req *http.Request) {
+	if f, _, err := negotiateFormat(req); nil == err && FORMATHTML == f {
+		adminView(handleSearch)(w, req)
+		return
+	}
+	hits, err := searchFromRequest(req)
+	if nil != err {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeSearchHits(w, hits)
+	debug("%v Searched, %v hits", adminWho(req), len(hits))
+}
+
+/* writeSearchHits writes hits to w as plain text, one per line */
+func writeSearchHits(w io.Writer, hits []searchHit) error {
+	for _, h := range hits {
+		s := h.Service
+		if "" == s {
+			s = "-"
+		}
+		if _, err := fmt.Fprintf(
+			w,
+			"%v\t%v\t%v\t%q\n",
+			h.Addr,
+			h.Port,
+			s,
+			h.Banner,
+		); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* searchCmd implements the search subcommand */
+func searchCmd(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	var (
+		dbFile = fs.String(
+			"db",
+			"/run/cgiscan/cgiscan.db",
+			"Database `file`",
+		)
+		storeKind = fs.String(
+			"store",
+			"bolt",
+			"Result storage `type`, one of "+
+				strings.Join(STORES, ", "),
+		)
+		adminPath = fs.String(
+			"admin",
+			"",
+			"Search via the admin socket at `path` instead of "+
+				"reading the database",
+		)
+		isRE = fs.Bool(
+			"re",
+			false,
+			"Treat the pattern as a regular expression",
+		)
+		field = fs.String(
+			"field",
+			"",
+			"Only search the given `field`, "+SEARCHBANNER+
+				" or "+SEARCHSERVICE,
+		)
+		port = fs.String(
+			"port",
+			"",
+			"Only search the given `port`",
+		)
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v search [options] pattern
+
+Searches the banners and services from the latest result for every address for
+the pattern, which is a case-insensitive substring unless -re is given.
+Matching ports are printed one per line, as the address, port, service, and
+quoted banner, separated by tabs.
+
+Options:
+`, os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 1 != fs.NArg() {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var sub, re string
+	if *isRE {
+		re = fs.Arg(0)
+	} else {
+		sub = fs.Arg(0)
+	}
+
+	/* Via a running instance */
+	if "" != *adminPath {
+		q := url.Values{}
+		q.Set("q", sub)
+		q.Set("re", re)
+		q.Set("field", *field)
+		q.Set("port", *port)
+		res, err := adminClient(*adminPath).Get(
+			"http://cgiscan/admin/search?" + q.Encode(),
+		)
+		if nil != err {
+			log.Fatalf("Unable to request search: %v", err)
+		}
+		defer res.Body.Close()
+		if http.StatusOK != res.StatusCode {
+			b, _ := io.ReadAll(res.Body)
+			log.Fatalf("Search failed (%v): %s", res.Status, b)
+		}
+		if _, err := io.Copy(os.Stdout, res.Body); nil != err {
+			log.Fatalf("Error receiving search results: %v", err)
+		}
+		return
+	}
+
+	/* From the database directly */
+	sq, err := parseSearchQuery(sub, re, *field, *port)
+	if nil != err {
+		log.Fatalf("Invalid search: %v", err)
+	}
+	if STORE, err = openStore(*storeKind, *dbFile, DBTIMEOUT); nil != err {
+		log.Fatalf("Unable to open database %v: %v", *dbFile, err)
+	}
+	defer STORE.Close()
+	if err := fillLatestPorts(); nil != err {
+		log.Fatalf("Unable to save latest ports: %v", err)
+	}
+	hits, err := search(sq)
+	if nil != err {
+		log.Fatalf("Error searching: %v", err)
+	}
+	writeSearchHits(os.Stdout, hits)
+}
@@ -0,0 +1,89 @@
+package main
+
+/*
+ * service.go
+ * Guess services from banners and ports
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"regexp"
+)
+
+/* bannerService maps a banner pattern to the service it indicates */
+type bannerService struct {
+	re      *regexp.Regexp
+	service string
+}
+
+/* BANNERSERVICES are checked in order against a banner */
+var BANNERSERVICES = []bannerService{
+	{regexp.MustCompile(`^SSH-`), "ssh"},
+	{regexp.MustCompile(`^HTTP/`), "http"},
+	{regexp.MustCompile(`^220[ -].*(?i:ftp)`), "ftp"},
+	{regexp.MustCompile(`^220[ -].*(?i:smtp|mail)`), "smtp"},
+	{regexp.MustCompile(`^\+OK`), "pop3"},
+	{regexp.MustCompile(`^\* (?:OK|PREAUTH)`), "imap"},
+	{regexp.MustCompile(`^RFB \d{3}\.\d{3}`), "vnc"},
+	{regexp.MustCompile(`^-ERR .*(?i:redis|auth)`), "redis"},
+	{regexp.MustCompile(`(?i:mysql|mariadb)`), "mysql"},
+	{regexp.MustCompile(`^:\S+ NOTICE `), "irc"},
+}
+
+/* PORTSERVICES are the usual services on well-known ports, used when the
+banner doesn't give the service away.  Names are as nmap uses them. */
+var PORTSERVICES = map[int]string{
+	21:    "ftp",
+	22:    "ssh",
+	23:    "telnet",
+	25:    "smtp",
+	53:    "domain",
+	80:    "http",
+	110:   "pop3",
+	111:   "rpcbind",
+	135:   "msrpc",
+	139:   "netbios-ssn",
+	143:   "imap",
+	389:   "ldap",
+	443:   "https",
+	445:   "microsoft-ds",
+	465:   "smtps",
+	587:   "submission",
+	636:   "ldapssl",
+	993:   "imaps",
+	995:   "pop3s",
+	1433:  "ms-sql-s",
+	3306:  "mysql",
+	3389:  "ms-wbt-server",
+	5432:  "postgresql",
+	5900:  "vnc",
+	6379:  "redis",
+	6667:  "irc",
+	8080:  "http-proxy",
+	8443:  "https-alt",
+	27017: "mongod",
+}
+
+/* guessService guesses the service on port p which sent banner b.  It
+returns the empty string if it has no idea. */
+func guessService(p int, b []byte) string {
+	if s := serviceFromBanner(b); "" != s {
+		return s
+	}
+	return PORTSERVICES[p]
+}
+
+/* serviceFromBanner returns the service banner b gives away, or the empty
+string if it doesn't */
+func serviceFromBanner(b []byte) string {
+	b = bytes.TrimSpace(b)
+	for _, bs := range BANNERSERVICES {
+		if bs.re.Match(b) {
+			return bs.service
+		}
+	}
+	return ""
+}
@@ -0,0 +1,390 @@
+package main
+
+/*
+ * share.go
+ * Unguessable links to a single scan result
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* SHAREBUCKET holds share links, by token */
+const SHAREBUCKET = "Shares"
+
+/* SHAREPATH is the URL path, after URLPATH, under which shared results are
+served */
+const SHAREPATH = "/r/"
+
+/* SHAREMAX is the most share links an address may have at once */
+const SHAREMAX = 20
+
+/* SHAREMAXLIFETIME is the longest a share link may last, if it expires */
+const SHAREMAXLIFETIME = 366 * 24 * time.Hour
+
+/* share is a link to a single scan result */
+type share struct {
+	Token   string     `json:"token"`
+	Addr    string     `json:"address"`
+	ID      string     `json:"id"` /* Scan ID */
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+/* expired returns true if s has expired */
+func (s share) expired() bool {
+	return nil != s.Expires && time.Now().After(*s.Expires)
+}
+
+/* URL returns the path, including URLPATH, of the shared result */
+func (s share) URL() string { return URLPATH + SHAREPATH + s.Token }
+
+/* newShareToken returns a new unguessable share token */
+func newShareToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); nil != err {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/* getShare gets the share with the given token, or nil if there is none or it
+has expired.  Expired shares are removed. */
+func getShare(tok string) (*share, error) {
+	v, err := STORE.GetKV(SHAREBUCKET, tok)
+	if nil != err || nil == v {
+		return nil, err
+	}
+	s := &share{}
+	if err := json.Unmarshal(v, s); nil != err {
+		return nil, fmt.Errorf("decoding share %v: %v", tok, err)
+	}
+	if s.expired() {
+		return nil, STORE.DeleteKV(SHAREBUCKET, tok)
+	}
+	return s, nil
+}
+
+/* addrShares returns a's unexpired shares, oldest first.  Expired shares are
+removed. */
+func addrShares(a string) ([]share, error) {
+	var ss, expired []share
+	if err := STORE.ForEachKV(
+		SHAREBUCKET,
+		func(k string, v []byte) error {
+			var s share
+			if err := json.Unmarshal(v, &s); nil != err {
+				return fmt.Errorf("decoding share %v: %v", k, err)
+			}
+			if a != s.Addr {
+				return nil
+			}
+			if s.expired() {
+				expired = append(expired, s)
+			} else {
+				ss = append(ss, s)
+			}
+			return nil
+		},
+	); nil != err {
+		return nil, err
+	}
+	for _, s := range expired {
+		if err := STORE.DeleteKV(SHAREBUCKET, s.Token); nil != err {
+			return nil, err
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Created.Before(ss[j].Created)
+	})
+	return ss, nil
+}
+
+/* addShare makes a share link to a's scan with the given ID, or the latest if
+id is the empty string, which expires after d, or never if d is 0 */
+func addShare(a, id string, d time.Duration) (*share, error) {
+	/* Don't let the bucket fill up */
+	ss, err := addrShares(a)
+	if nil != err {
+		return nil, err
+	}
+	if SHAREMAX <= len(ss) {
+		return nil, fmt.Errorf(
+			"too many share links; %v may have %v at once",
+			a,
+			SHAREMAX,
+		)
+	}
+
+	/* Make sure there's a scan to share */
+	r, err := findScan(a, id)
+	if nil != err {
+		return nil, err
+	}
+	if nil == r {
+		if "" == id {
+			return nil, fmt.Errorf("no scan results for %v", a)
+		}
+		return nil, fmt.Errorf("no scan %v for %v", id, a)
+	}
+
+	/* Save the share */
+	s := &share{Addr: a, ID: r.ID, Created: time.Now()}
+	if s.Token, err = newShareToken(); nil != err {
+		return nil, err
+	}
+	if 0 != d {
+		exp := s.Created.Add(d)
+		s.Expires = &exp
+	}
+	v, err := json.Marshal(s)
+	if nil != err {
+		return nil, err
+	}
+	if err := STORE.PutKV(SHAREBUCKET, s.Token, v); nil != err {
+		return nil, err
+	}
+	return s, nil
+}
+
+/* removeShares removes all of a's share links */
+func removeShares(a string) error {
+	ss, err := addrShares(a)
+	if nil != err {
+		return err
+	}
+	for _, s := range ss {
+		if err := STORE.DeleteKV(SHAREBUCKET, s.Token); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* findScan returns a's scan with the given ID, or the latest if id is the
+empty string.  It returns nil if there's no such scan. */
+func findScan(a, id string) (*result, error) {
+	if "" == id {
+		return STORE.Get(a)
+	}
+	rs, err := STORE.History(a)
+	if nil != err {
+		return nil, err
+	}
+	for _, r := range rs {
+		if id == r.ID {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+/* parseShareLifetime parses how long a share link should last.  The empty
+string means it never expires. */
+func parseShareLifetime(s string) (time.Duration, error) {
+	if "" == s {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if nil != err {
+		return 0, err
+	}
+	if 0 >= d || SHAREMAXLIFETIME < d {
+		return 0, fmt.Errorf(
+			"share link lifetime must be positive and at most %v",
+			SHAREMAXLIFETIME,
+		)
+	}
+	return d, nil
+}
+
+/* handleShare makes a share link for one of the requestor's scans, given in
+the id form value, or the latest if there's no id.  The link expires after the
+duration in the expires form value, if there is one. */
+func handleShare(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Can't share what the requestor can't see */
+	if !canSee(rip, rip) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, hiddenMessage(rip))
+		return
+	}
+
+	/* Make sure the requestor really meant it */
+	if !confirmOrCheck(w, req, rip, "/share", confirmPage{
+		Title:  "Share",
+		Prompt: fmt.Sprintf("Make a link to a scan result for %v?", rip),
+		Button: "Share",
+		Fields: map[string]string{
+			"id":      req.FormValue("id"),
+			"expires": req.FormValue("expires"),
+		},
+	}) {
+		return
+	}
+
+	/* Make the link */
+	d, err := parseShareLifetime(req.PostFormValue("expires"))
+	if nil != err {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	s, err := addShare(rip, req.PostFormValue("id"), d)
+	if nil != err {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		debug("%v Failed to make share link: %v", rip, err)
+		return
+	}
+	debug("%v Shared scan %v", rip, s.ID)
+
+	/* The link's on the status page */
+	http.Redirect(w, req, URLPATH, http.StatusSeeOther)
+}
+
+/* handleUnshare revokes the requestor's share link with the token in the
+token form value */
+func handleUnshare(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Make sure the requestor really meant it */
+	tok := req.FormValue("token")
+	if !confirmOrCheck(w, req, rip, "/unshare", confirmPage{
+		Title:  "Revoke",
+		Prompt: "Revoke the share link?",
+		Button: "Revoke",
+		Fields: map[string]string{"token": tok},
+	}) {
+		return
+	}
+
+	/* Only the requestor's own links may be revoked */
+	s, err := getShare(tok)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if nil == s || rip != s.Addr {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "No such share link.")
+		return
+	}
+	if err := STORE.DeleteKV(SHAREBUCKET, s.Token); nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	debug("%v Revoked share link for scan %v", rip, s.ID)
+
+	http.Redirect(w, req, URLPATH, http.StatusSeeOther)
+}
+
+/* sharedResult sends the scan result shared with the token at the end of the
+URL.  Like /res/, .json and .sig give the signed report and signature. */
+func sharedResult(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Work out what's shared */
+	tok, ext := strings.TrimPrefix(req.URL.Path, URLPATH+SHAREPATH), ""
+	if i := strings.LastIndex(tok, "."); -1 != i {
+		tok, ext = tok[:i], tok[i+1:]
+	}
+	s, err := getShare(tok)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if nil == s {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "No such shared result.  It may have expired "+
+			"or been revoked.")
+		debug("%v Requested unknown share link", rip)
+		return
+	}
+	/* Owners may share their own results, unless only admins may see
+	them */
+	if !canSee(s.Addr, s.Addr) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, hiddenMessage(s.Addr))
+		debug("%v Refused share link for %v", rip, s.Addr)
+		return
+	}
+	if "" != ext {
+		sendScanFile(w, req, s.Addr, s.ID, ext)
+		return
+	}
+
+	/* Work out how to send it */
+	f, code, err := negotiateFormat(req)
+	if nil != err {
+		formatFail(w, FORMATTEXT, code, "%v", err)
+		return
+	}
+	r, err := findScan(s.Addr, s.ID)
+	if nil != err {
+		formatFail(w, f, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if nil == r {
+		formatFail(w, f, http.StatusNotFound, "Shared scan no longer exists")
+		return
+	}
+	setFormatHeaders(w, f)
+	if FORMATHTML != f {
+		if err := writeResult(w, f, r, nil); nil != err {
+			debug("%v Error sending shared %v result: %v", rip, f, err)
+		}
+		return
+	}
+	if err := renderPage(w, "shared.html", sharedPage{
+		Share:  *s,
+		Result: r,
+		Report: string(r.Report()),
+		Signed: nil != SIGKEY && nil != r.Sig,
+	}); nil != err {
+		return
+	}
+	debug("%v Sent shared scan %v of %v", rip, s.ID, s.Addr)
+}
+
+/* sharedPage is what's needed to render a shared result */
+type sharedPage struct {
+	Share  share
+	Result *result
+	Report string
+	Signed bool
+}
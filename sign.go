@@ -0,0 +1,304 @@
+package main
+
+/*
+ * sign.go
+ * Sign and verify scan reports
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/* PUBKEYPATH is the URL path, after URLPATH, of the public signing key */
+const PUBKEYPATH = "/.well-known/cgiscan-signing-key.pem"
+
+/* SIGKEY signs reports */
+var SIGKEY ed25519.PrivateKey
+
+/* loadSigningKey loads the PEM-encoded PKCS8 Ed25519 private key in the file
+at path into SIGKEY.  If the file doesn't exist, a new key is generated and
+saved in it. */
+func loadSigningKey(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newSigningKey(path)
+	} else if nil != err {
+		return err
+	}
+
+	/* Parse the key */
+	p, _ := pem.Decode(b)
+	if nil == p {
+		return fmt.Errorf("no PEM data in %v", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(p.Bytes)
+	if nil != err {
+		return err
+	}
+	var ok bool
+	if SIGKEY, ok = k.(ed25519.PrivateKey); !ok {
+		return fmt.Errorf("key in %v is a %T, not Ed25519", path, k)
+	}
+	return nil
+}
+
+/* newSigningKey generates a new signing key in SIGKEY and saves it to the
+file at path */
+func newSigningKey(path string) error {
+	/* Make the key */
+	var err error
+	if _, SIGKEY, err = ed25519.GenerateKey(rand.Reader); nil != err {
+		return err
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(SIGKEY)
+	if nil != err {
+		return err
+	}
+
+	/* Save it */
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: b,
+	}); nil != err {
+		return err
+	}
+	log.Printf("Generated new signing key in %v", path)
+	return f.Close()
+}
+
+/* publicKeyPEM returns SIGKEY's public key, PEM-encoded */
+func publicKeyPEM() ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(SIGKEY.Public())
+	if nil != err {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), nil
+}
+
+/* signResult signs r's report, as it is now, and puts the signature in
+r.Sig.  It should only be called on results which have just been scanned. */
+func signResult(r *result) error {
+	r.Sig = nil
+	report, err := encodeResult(r)
+	if nil != err {
+		return err
+	}
+	r.Sig = ed25519.Sign(SIGKEY, report)
+	return nil
+}
+
+/* signedReport returns the report for r which was signed when r was scanned,
+and r's stored signature, base64-encoded with a trailing newline.  It returns
+nils if r wasn't signed, which is the case for imported results and those
+stored by older versions of cgiscan, or if the signature doesn't match the
+report and SIGKEY, as happens when results are changed. */
+func signedReport(r *result) (report, sig []byte, err error) {
+	if nil == SIGKEY || nil == r.Sig {
+		return nil, nil, nil
+	}
+	u := *r
+	u.Sig = nil
+	if report, err = encodeResult(&u); nil != err {
+		return nil, nil, err
+	}
+	if !ed25519.Verify(
+		SIGKEY.Public().(ed25519.PublicKey),
+		report,
+		r.Sig,
+	) {
+		return nil, nil, nil
+	}
+	sig = []byte(base64.StdEncoding.EncodeToString(r.Sig) + "\n")
+	return report, sig, nil
+}
+
+/* sendPublicKey sends back the public half of SIGKEY */
+func sendPublicKey(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if nil == SIGKEY {
+		http.NotFound(w, req)
+		return
+	}
+	b, err := publicKeyPEM()
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(b)
+	debug("%v Sent public key", rip)
+}
+
+/* sendScanFile sends the signed report (if ext is "json") or its signature
+(if ext is "sig") for the scan of a with the given ID */
+func sendScanFile(w http.ResponseWriter, req *http.Request, a, id, ext string) {
+	/* Requestor's IP */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if nil == SIGKEY || ("json" != ext && "sig" != ext) {
+		http.NotFound(w, req)
+		return
+	}
+
+	/* Find the scan */
+	rs, err := STORE.History(a)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	var r *result
+	for _, hr := range rs {
+		if id == hr.ID {
+			r = hr
+			break
+		}
+	}
+	if nil == r {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, fmt.Sprintf("No scan %v for %v", id, a))
+		return
+	}
+
+	/* Send the report or signature */
+	report, sig, err := signedReport(r)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if nil == sig {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, fmt.Sprintf(
+			"Scan %v of %v isn't signed",
+			id,
+			a,
+		))
+		debug("%v Requested unsigned scan %v of %v", rip, id, a)
+		return
+	}
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%v-%v.%v\"", a, id, ext),
+	)
+	if "json" == ext {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(report)
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(sig)
+	}
+	debug("%v Sent %v for scan %v of %v", rip, ext, id, a)
+}
+
+/* verifyCmd implements the verify subcommand */
+func verifyCmd(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFile := fs.String(
+		"key",
+		"",
+		"PEM-encoded public key `file`, from "+PUBKEYPATH,
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v verify -key file report.json report.sig
+
+Verifies the signature on a report downloaded from /res/<address>/<id>.json,
+using the signature from /res/<address>/<id>.sig and the server's public key.
+Exits non-zero if the signature is bad.
+
+Options:
+`, os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if "" == *keyFile || 2 != fs.NArg() {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	/* Get the public key */
+	b, err := os.ReadFile(*keyFile)
+	if nil != err {
+		log.Fatalf("Unable to read key: %v", err)
+	}
+	p, _ := pem.Decode(b)
+	if nil == p {
+		log.Fatalf("No PEM data in %v", *keyFile)
+	}
+	k, err := x509.ParsePKIXPublicKey(p.Bytes)
+	if nil != err {
+		log.Fatalf("Unable to parse key: %v", err)
+	}
+	pub, ok := k.(ed25519.PublicKey)
+	if !ok {
+		log.Fatalf("Key in %v is a %T, not Ed25519", *keyFile, k)
+	}
+
+	/* Get the report and signature */
+	report, err := os.ReadFile(fs.Arg(0))
+	if nil != err {
+		log.Fatalf("Unable to read report: %v", err)
+	}
+	b, err = os.ReadFile(fs.Arg(1))
+	if nil != err {
+		log.Fatalf("Unable to read signature: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(string(b)),
+	)
+	if nil != err {
+		log.Fatalf("Unable to decode signature: %v", err)
+	}
+
+	/* Check it */
+	if !ed25519.Verify(pub, report, sig) {
+		log.Fatalf("BAD SIGNATURE")
+	}
+	r, err := decodeResult("", report)
+	if nil != err {
+		log.Fatalf("Good signature, but unable to parse report: %v", err)
+	}
+	fmt.Printf(
+		"Good signature for scan %v of %v, finished %v, %v open ports\n",
+		r.ID,
+		r.Addr,
+		r.End.UTC().Format(time.RFC3339),
+		len(r.Ports),
+	)
+}
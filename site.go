@@ -0,0 +1,150 @@
+package main
+
+/*
+ * site.go
+ * Operator's site configuration and static files
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+/* STATICPATH is the URL path, after URLPATH, under which static files are
+served */
+const STATICPATH = "/static/"
+
+/* DEFSTATIC are the default static files */
+//go:embed static
+var DEFSTATIC embed.FS
+
+/* siteConfig describes the site's operator and look */
+type siteConfig struct {
+	Title      string      `json:"title"`      /* Prefix for page titles */
+	Operator   string      `json:"operator"`   /* Who runs the site */
+	Contact    string      `json:"contact"`    /* Email address or URL */
+	Abuse      string      `json:"abuse"`      /* Email address or URL */
+	Terms      string      `json:"terms"`      /* Terms of use */
+	Stylesheet string      `json:"stylesheet"` /* URL of the stylesheet */
+	Badge      badgePolicy `json:"badge"`      /* Badge colours */
+}
+
+/* SITE is the site configuration, settable with -site */
+var SITE = siteConfig{Title: "CGIScan"}
+
+/* STATICDIR, if set, holds static files served in preference to the
+defaults */
+var STATICDIR string
+
+/* loadSiteConfig reads the JSON site config in the file at fn into SITE.
+Settings missing from the file keep their defaults. */
+func loadSiteConfig(fn string) error {
+	f, err := os.Open(fn)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	return dec.Decode(&SITE)
+}
+
+/* stylesheetURL returns the configured stylesheet's URL, or the default
+stylesheet's if none is configured */
+func stylesheetURL() string {
+	if "" != SITE.Stylesheet {
+		return SITE.Stylesheet
+	}
+	return URLPATH + STATICPATH + "style.css"
+}
+
+/* contactURL turns c into a mailto: URL if it's a bare email address */
+func contactURL(c string) string {
+	if strings.Contains(c, "@") && !strings.Contains(c, ":") {
+		return "mailto:" + c
+	}
+	return c
+}
+
+/* paragraphs splits s into paragraphs, separated by blank lines */
+func paragraphs(s string) []string {
+	var ps []string
+	for _, p := range strings.Split(
+		strings.ReplaceAll(s, "\r\n", "\n"),
+		"\n\n",
+	) {
+		if p = strings.TrimSpace(p); "" != p {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+/* openStatic opens the static file named n, from STATICDIR if it's there
+or the defaults if not */
+func openStatic(n string) (fs.File, error) {
+	if "" != STATICDIR {
+		f, err := os.DirFS(STATICDIR).Open(n)
+		if nil == err {
+			return f, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return DEFSTATIC.Open("static/" + n)
+}
+
+/* sendStatic sends back the static file named at the end of the URL */
+func sendStatic(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Work out which file */
+	n := strings.TrimPrefix(req.URL.Path, URLPATH+STATICPATH)
+	if !fs.ValidPath(n) || "." == n {
+		http.NotFound(w, req)
+		return
+	}
+	f, err := openStatic(n)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, req)
+		return
+	} else if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if fi.IsDir() || !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	/* Send it */
+	w.Header().Set("Cache-Control", "max-age=3600")
+	http.ServeContent(w, req, path.Base(n), fi.ModTime(), rs)
+	debug("%v Sent static file %v", rip, n)
+}
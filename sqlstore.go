@@ -0,0 +1,333 @@
+package main
+
+/*
+ * sqlstore.go
+ * Store results in an SQLite database
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/* SQLSCHEMA sets up an SQLite database.  The results table holds every
+result, and the ports table holds the open ports from each result, to make
+them easy to query with SQL.  The kv table holds everything else. */
+const SQLSCHEMA = `
+CREATE TABLE IF NOT EXISTS results (
+	address TEXT NOT NULL,
+	id      TEXT NOT NULL,
+	start   TEXT NOT NULL,
+	end     TEXT NOT NULL,
+	result  TEXT NOT NULL,
+	PRIMARY KEY (address, id)
+);
+CREATE TABLE IF NOT EXISTS ports (
+	address TEXT NOT NULL,
+	id      TEXT NOT NULL,
+	port    INTEGER NOT NULL,
+	banner  BLOB,
+	PRIMARY KEY (address, id, port),
+	FOREIGN KEY (address, id) REFERENCES results (address, id)
+		ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS kv (
+	bucket TEXT NOT NULL,
+	key    TEXT NOT NULL,
+	value  BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+);
+CREATE VIEW IF NOT EXISTS latest AS
+	SELECT * FROM results r WHERE id = (
+		SELECT MAX(id) FROM results WHERE address = r.address
+	);
+`
+
+/* sqlStore is a Store backed by an SQLite database */
+type sqlStore struct {
+	db *sql.DB
+}
+
+/* openSQLStore opens the SQLite database at path and makes sure it has the
+tables it needs.  If timeout is nonzero, it is used as SQLite's busy
+timeout. */
+func openSQLStore(path string, timeout time.Duration) (*sqlStore, error) {
+	q := url.Values{}
+	q.Set("_foreign_keys", "1")
+	if 0 != timeout {
+		q.Set("_busy_timeout", fmt.Sprintf(
+			"%v",
+			timeout.Milliseconds(),
+		))
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+q.Encode())
+	if nil != err {
+		return nil, err
+	}
+	if _, err := db.Exec(SQLSCHEMA); nil != err {
+		db.Close()
+		return nil, fmt.Errorf("unable to create tables: %v", err)
+	}
+	return &sqlStore{db: db}, nil
+}
+
+/* Save implements Store.Save */
+func (s *sqlStore) Save(r *result) error {
+	r.setID()
+	v, err := encodeResult(r)
+	if nil != err {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if nil != err {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(
+		`DELETE FROM results WHERE address = ? AND id = ?`,
+		r.Addr,
+		r.ID,
+	); nil != err {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO results (address, id, start, end, result)
+		VALUES (?, ?, ?, ?, ?)`,
+		r.Addr,
+		r.ID,
+		r.Start.UTC().Format(time.RFC3339Nano),
+		r.End.UTC().Format(time.RFC3339Nano),
+		string(v),
+	); nil != err {
+		return err
+	}
+	for _, p := range r.Ports {
+		if _, err := tx.Exec(
+			`INSERT INTO ports (address, id, port, banner)
+			VALUES (?, ?, ?, ?)`,
+			r.Addr,
+			r.ID,
+			p.Port,
+			p.Banner,
+		); nil != err {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/* Get implements Store.Get */
+func (s *sqlStore) Get(a string) (*result, error) {
+	var v string
+	err := s.db.QueryRow(
+		`SELECT result FROM latest WHERE address = ?`,
+		a,
+	).Scan(&v)
+	/* Return nil if there's no previous scan */
+	if sql.ErrNoRows == err {
+		return nil, nil
+	} else if nil != err {
+		return nil, err
+	}
+	return decodeResult(a, []byte(v))
+}
+
+/* List implements Store.List */
+func (s *sqlStore) List(f func(r *result) error) error {
+	return s.query(
+		f,
+		`SELECT address, result FROM latest ORDER BY address`,
+	)
+}
+
+/* Delete implements Store.Delete */
+func (s *sqlStore) Delete(a string) error {
+	_, err := s.db.Exec(`DELETE FROM results WHERE address = ?`, a)
+	return err
+}
+
+/* History implements Store.History */
+func (s *sqlStore) History(a string) ([]*result, error) {
+	var rs []*result
+	err := s.query(
+		func(r *result) error {
+			rs = append(rs, r)
+			return nil
+		},
+		`SELECT address, result FROM results WHERE address = ?
+		ORDER BY id`,
+		a,
+	)
+	return rs, err
+}
+
+/* PutKV implements Store.PutKV */
+func (s *sqlStore) PutKV(bucket, k string, v []byte) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO kv (bucket, key, value) VALUES (?, ?, ?)`,
+		bucket,
+		k,
+		v,
+	)
+	return err
+}
+
+/* GetKV implements Store.GetKV */
+func (s *sqlStore) GetKV(bucket, k string) ([]byte, error) {
+	var v []byte
+	err := s.db.QueryRow(
+		`SELECT value FROM kv WHERE bucket = ? AND key = ?`,
+		bucket,
+		k,
+	).Scan(&v)
+	if sql.ErrNoRows == err {
+		return nil, nil
+	}
+	return v, err
+}
+
+/* DeleteKV implements Store.DeleteKV */
+func (s *sqlStore) DeleteKV(bucket, k string) error {
+	_, err := s.db.Exec(
+		`DELETE FROM kv WHERE bucket = ? AND key = ?`,
+		bucket,
+		k,
+	)
+	return err
+}
+
+/* ForEachKV implements Store.ForEachKV */
+func (s *sqlStore) ForEachKV(
+	bucket string,
+	f func(k string, v []byte) error,
+) error {
+	rows, err := s.db.Query(
+		`SELECT key, value FROM kv WHERE bucket = ? ORDER BY key`,
+		bucket,
+	)
+	if nil != err {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			k string
+			v []byte
+		)
+		if err := rows.Scan(&k, &v); nil != err {
+			return err
+		}
+		if err := f(k, v); nil != err {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+/* ForEachKVFrom implements Store.ForEachKVFrom */
+func (s *sqlStore) ForEachKVFrom(
+	bucket, from string,
+	desc bool,
+	f func(k string, v []byte) error,
+) error {
+	var (
+		cond  = ` AND key >= ?`
+		order = ` ORDER BY key`
+		args  = []interface{}{bucket, from}
+	)
+	if desc {
+		cond, order = ` AND key <= ?`, ` ORDER BY key DESC`
+	}
+	if "" == from {
+		cond, args = "", args[:1]
+	}
+	rows, err := s.db.Query(
+		`SELECT key, value FROM kv WHERE bucket = ?`+cond+order,
+		args...,
+	)
+	if nil != err {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			k string
+			v []byte
+		)
+		if err := rows.Scan(&k, &v); nil != err {
+			return err
+		}
+		if err := f(k, v); ERRSTOPWALK == err {
+			return nil
+		} else if nil != err {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+/* Backup implements backupper.Backup.  It has SQLite write a copy of the
+database to a temporary file, which is then copied to w. */
+func (s *sqlStore) Backup(w io.Writer) (int64, error) {
+	/* Get somewhere to put the copy */
+	d, err := os.MkdirTemp("", "cgiscan-backup")
+	if nil != err {
+		return 0, err
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "cgiscan.db")
+
+	/* Have SQLite make it */
+	if _, err := s.db.Exec(`VACUUM INTO ?`, fn); nil != err {
+		return 0, err
+	}
+
+	/* Send it back */
+	f, err := os.Open(fn)
+	if nil != err {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+/* query calls f on each result returned by the query q, which must select an
+address and an encoded result */
+func (s *sqlStore) query(
+	f func(r *result) error,
+	q string,
+	args ...interface{},
+) error {
+	rows, err := s.db.Query(q, args...)
+	if nil != err {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a, v string
+		if err := rows.Scan(&a, &v); nil != err {
+			return err
+		}
+		r, err := decodeResult(a, []byte(v))
+		if nil != err {
+			return fmt.Errorf("decoding result for %v: %v", a, err)
+		}
+		if err := f(r); nil != err {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+/* Close implements Store.Close */
+func (s *sqlStore) Close() error { return s.db.Close() }
@@ -0,0 +1,251 @@
+package main
+
+/*
+ * stats.go
+ * Persistent service statistics
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* STATSBUCKET holds a dayStats for each day, keyed by date */
+const STATSBUCKET = "Stats"
+
+/* STATSDAY is the format of the keys in STATSBUCKET */
+const STATSDAY = "2006-01-02"
+
+/* Scan durations are counted in STATSNBUCKET buckets, each STATSGROWTH times
+as wide as the last, starting at STATSMIN.  This keeps percentiles to within
+about 10% with a fixed amount of storage per day. */
+const (
+	STATSMIN     = 100 * time.Millisecond
+	STATSGROWTH  = 1.1
+	STATSNBUCKET = 200
+)
+
+/* dayStats are the statistics for the scans finished in one day */
+type dayStats struct {
+	Scans     int           `json:"scans"`
+	OpenPorts int           `json:"open_ports"`
+	Total     time.Duration `json:"total_duration"`
+	/* Number of scans in each duration bucket, by index */
+	Hist map[int]int `json:"duration_histogram"`
+	/* Durations, as stored by older versions.  They're moved into Total
+	and Hist when loaded. */
+	Durations []time.Duration `json:"durations,omitempty"`
+}
+
+/* statsSummary summarizes a set of dayStats */
+type statsSummary struct {
+	Scans     int
+	OpenPorts int
+	Average   time.Duration
+	Median    time.Duration
+	P90       time.Duration
+	P99       time.Duration
+}
+
+/* Statistics, loaded from the Store at startup */
+var (
+	STATS      = make(map[string]*dayStats) /* Statistics by day */
+	STATSTOTAL *statsSummary                /* Cached summary of STATS */
+	STATSLOCK  = &sync.Mutex{}              /* Lock for STATS */
+)
+
+/* statsBucket returns the index of the bucket in which d is counted */
+func statsBucket(d time.Duration) int {
+	if d <= STATSMIN {
+		return 0
+	}
+	i := int(math.Ceil(
+		math.Log(float64(d)/float64(STATSMIN)) / math.Log(STATSGROWTH),
+	))
+	if STATSNBUCKET <= i {
+		i = STATSNBUCKET - 1
+	}
+	return i
+}
+
+/* statsBucketBound returns the longest duration counted in bucket i */
+func statsBucketBound(i int) time.Duration {
+	return time.Duration(
+		float64(STATSMIN) * math.Pow(STATSGROWTH, float64(i)),
+	)
+}
+
+/* add counts a scan which took d */
+func (ds *dayStats) add(d time.Duration) {
+	if nil == ds.Hist {
+		ds.Hist = make(map[int]int)
+	}
+	ds.Total += d
+	ds.Hist[statsBucket(d)]++
+}
+
+/* loadStats loads the statistics from STORE */
+func loadStats() error {
+	STATSLOCK.Lock()
+	defer STATSLOCK.Unlock()
+	return STORE.ForEachKV(STATSBUCKET, func(k string, v []byte) error {
+		var ds dayStats
+		if err := json.Unmarshal(v, &ds); nil != err {
+			return fmt.Errorf("decoding stats for %v: %v", k, err)
+		}
+		for _, d := range ds.Durations {
+			ds.add(d)
+		}
+		ds.Durations = nil
+		STATS[k] = &ds
+		return nil
+	})
+}
+
+/* recordStats adds the finished scan r to the statistics and saves the
+updated statistics for its day */
+func recordStats(r *result) error {
+	STATSLOCK.Lock()
+	defer STATSLOCK.Unlock()
+
+	/* Update the day's statistics */
+	day := r.End.UTC().Format(STATSDAY)
+	ds, ok := STATS[day]
+	if !ok {
+		ds = &dayStats{}
+		STATS[day] = ds
+	}
+	ds.Scans++
+	ds.OpenPorts += len(r.Ports)
+	ds.add(r.End.Sub(r.Start))
+	STATSTOTAL = nil
+
+	/* Save them */
+	v, err := json.Marshal(ds)
+	if nil != err {
+		return err
+	}
+	return STORE.PutKV(STATSBUCKET, day, v)
+}
+
+/* summarize summarizes the statistics for the given days, or every day if no
+days are given.  The caller must hold STATSLOCK. */
+func summarize(days ...string) statsSummary {
+	if 0 == len(days) {
+		for day := range STATS {
+			days = append(days, day)
+		}
+	}
+
+	/* Add up the days */
+	var (
+		s     statsSummary
+		hist  [STATSNBUCKET]int
+		n     int
+		total time.Duration
+	)
+	for _, day := range days {
+		st, ok := STATS[day]
+		if !ok {
+			continue
+		}
+		s.Scans += st.Scans
+		s.OpenPorts += st.OpenPorts
+		total += st.Total
+		for i, c := range st.Hist {
+			if 0 <= i && STATSNBUCKET > i {
+				hist[i] += c
+				n += c
+			}
+		}
+	}
+	if 0 == n {
+		return s
+	}
+
+	/* Work out the average and percentiles */
+	s.Average = total / time.Duration(n)
+	s.Median = percentile(hist[:], n, 50)
+	s.P90 = percentile(hist[:], n, 90)
+	s.P99 = percentile(hist[:], n, 99)
+	return s
+}
+
+/* percentile returns the upper bound of the bucket holding the pth
+percentile of the n durations counted in hist, using the nearest-rank
+method */
+func percentile(hist []int, n, p int) time.Duration {
+	r := (p*n + 99) / 100 /* Rank, rounded up */
+	if r < 1 {
+		r = 1
+	}
+	var seen int
+	for i, c := range hist {
+		if seen += c; seen >= r {
+			return statsBucketBound(i)
+		}
+	}
+	return statsBucketBound(len(hist) - 1)
+}
+
+/* totalStats returns a summary of all of the statistics, which is cached
+until the next scan is recorded */
+func totalStats() statsSummary {
+	STATSLOCK.Lock()
+	defer STATSLOCK.Unlock()
+	if nil == STATSTOTAL {
+		s := summarize()
+		STATSTOTAL = &s
+	}
+	return *STATSTOTAL
+}
+
+/* stats sends back a page of statistics by day */
+func stats(w http.ResponseWriter, req *http.Request) {
+	/* Get the requestor's address */
+	rip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	/* Summarize each day, newest first, to keep the locking short */
+	STATSLOCK.Lock()
+	days := make([]string, 0, len(STATS))
+	for day := range STATS {
+		days = append(days, day)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(days)))
+	lines := make([]statsLine, 0, len(days)+1)
+	for _, day := range days {
+		lines = append(lines, statsLine{day, summarize(day)})
+	}
+	STATSLOCK.Unlock()
+	lines = append(lines, statsLine{"Total", totalStats()})
+
+	/* Send them back */
+	if err := renderPage(w, "stats.html", struct {
+		Days []statsLine
+	}{lines}); nil != err {
+		return
+	}
+
+	debug("%v Sent statistics for %v days", rip, len(days))
+}
+
+/* statsLine is a labelled line of the statistics table */
+type statsLine struct {
+	Label string
+	statsSummary
+}
@@ -5,10 +5,12 @@ package main
  * Main (status) page
  * By J. Stuart McMurray
  * Created 20160706
- * Last Modified 20160706
+ * Last Modified 20261018
  */
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -26,101 +28,200 @@ func status(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	/* Work out how to send it */
+	f, code, err := negotiateFormat(req)
+	if nil != err {
+		formatFail(w, FORMATTEXT, code, "%v", err)
+		return
+	}
+	if FORMATHTML != f {
+		statusFormatted(w, ip, f)
+		return
+	}
+
 	/* Work out queue position and if it's scanning, and associated time */
 	queued, started, startTime, qpos, qlen := inQueue(ip)
-
-	/* Come up with a helpful status message */
-	var qmsg string
-	wt := time.Now().Sub(startTime) /* Time since startTime */
-	/* Come up with a helpful message */
-	if started { /* Report that we're scanning */
-		st := startTime.UTC().Format(time.RFC3339) /* Start Time */
-		qmsg = fmt.Sprintf(
-			"Scanning now.  Start time %v (%v ago).",
-			st,
-			wt,
-		)
-		debug("%v Reporting running since %v (%v)", ip, st, wt)
-	} else if queued { /* Report queue position */
-		qmsg = fmt.Sprintf(
-			"Queue position: %v (waiting %v)",
-			qpos,
-			wt,
+	page := statusPage{
+		Addr:        ip,
+		Scanning:    started,
+		Queued:      queued,
+		Since:       startTime,
+		Waiting:     time.Now().Sub(startTime),
+		Position:    qpos,
+		QueueLength: qlen,
+		Uptime:      time.Now().Sub(START),
+		Stats:       totalStats(),
+		ScanToken:   csrfToken(ip, "/scan"),
+	}
+	if started {
+		debug(
+			"%v Reporting running since %v (%v)",
+			ip,
+			startTime.UTC().Format(time.RFC3339),
+			page.Waiting,
 		)
+	} else if queued {
 		debug(
 			"%v Reporting queued in position %v (%v)",
 			ip,
 			qpos,
-			wt,
-		)
-	} else { /* Report last results */
-		qmsg = fmt.Sprintf(
-			"<A HREF=\"%v/scan\">Click here to (re)scan</A>",
-			URLPATH,
+			page.Waiting,
 		)
 	}
 
-	/* Get the last results */
-	res, err := lastRes(ip)
-	if nil != err {
-		res = []byte(fmt.Sprintf("ERROR: %v", err))
+	/* Get the last results, if the requestor may see them */
+	if !canSee(ip, ip) {
+		page.Report = "\n" + hiddenMessage(ip)
+	} else if r, err := STORE.Get(ip); nil != err {
+		page.Report = fmt.Sprintf("ERROR: %v", err)
+	} else if nil == r || 0 == len(r.Report()) {
+		page.Report = "\nNo results."
+	} else {
+		page.Report = string(r.Report())
+		page.LatestID = r.ID
 	}
-	if nil == res || 0 == len(res) {
-		res = []byte("\nNo results.")
+
+	/* Links to them */
+	if page.Shares, err = addrShares(ip); nil != err {
+		page.SharesError = err.Error()
 	}
+	page.ShareToken = csrfToken(ip, "/share")
+	page.UnshareToken = csrfToken(ip, "/unshare")
 
-	/* Return them */
-	io.WriteString(
-		w,
-		fmt.Sprintf(
-			`<!DOCTYPE HTML>
-<HTML>
-<HEAD>
-	<TITLE>CGIScan</TITLE>
-	<STYLE TYPE="text/css"><!--
-		body {
-			background-color: white;
-			color: black;
-			font-family: 'Comic Sans MS', 'Chalkboard SE', 'Comic Neue', sans-serif;
-		}
-		p {
-			font-size: xx-small;
-		}
-	--></STYLE>
-</HEAD>
-<BODY>
-	<H1>CGIScan for %v</H1>
-	<P>More information at
-		<A HREF="%v/help">
-			%v/help
-		</A>
-	</P>
-	<PRE>
-%v
+	/* Return them, with the service statistics */
+	setFormatHeaders(w, f)
+	if err := renderPage(w, "status.html", page); nil != err {
+		return
+	}
+	debug("%v Reported status", ip)
+}
 
-     Queue length: %v
-   Service uptime: %v
-  Completed scans: %v
-Average scan time: %v
+/* statusPage is what's needed to render the status page */
+type statusPage struct {
+	Addr         string
+	Scanning     bool
+	Queued       bool
+	Since        time.Time
+	Waiting      time.Duration
+	Position     int
+	QueueLength  int
+	Uptime       time.Duration
+	Stats        statsSummary
+	Report       string
+	ScanToken    string /* CSRF token for the scan form */
+	LatestID     string /* Latest scan's ID, if there is one */
+	Shares       []share
+	SharesError  string
+	ShareToken   string /* CSRF token for the share form */
+	UnshareToken string /* CSRF token for revoking shares */
+}
 
-Most recent scan results:
+/* statusFormatted sends the status for the requestor at ip in format f,
+which must not be FORMATHTML.  The CSV and nmap XML are just the most recent
+scan's. */
+func statusFormatted(w http.ResponseWriter, ip, f string) {
+	s, err := getStatus(ip)
+	if nil != err {
+		formatFail(w, f, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	setFormatHeaders(w, f)
+
+	/* Some formats don't need much */
+	switch f {
+	case FORMATJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(s)
+		debug("%v Reported %v status: %v", ip, f, s.State)
+		return
+	case FORMATCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(CSVHEADER)
+		if nil != s.Latest {
+			writeResultCSV(cw, s.Latest)
+		}
+		cw.Flush()
+		debug("%v Reported %v status: %v", ip, f, s.State)
+		return
+	case FORMATNMAPXML:
+		if nil == s.Latest {
+			writeNmapXML(w)
+		} else {
+			writeNmapXML(w, s.Latest)
+		}
+		debug("%v Reported %v status: %v", ip, f, s.State)
+		return
+	}
 
-%s
-</PRE>
-</BODY>
-</HTML>
-`,
+	/* Human-readable ones get a summary first */
+	noRes := "No results."
+	if !canSee(ip, ip) {
+		noRes = hiddenMessage(ip)
+	}
+	var qmsg string
+	switch s.State {
+	case STATESCANNING:
+		qmsg = fmt.Sprintf(
+			"Scanning now.  Start time %v (%v ago).",
+			s.Since.UTC().Format(time.RFC3339),
+			time.Since(*s.Since),
+		)
+	case STATEQUEUED:
+		qmsg = fmt.Sprintf(
+			"Queue position: %v (waiting %v)",
+			s.Position,
+			time.Since(*s.Since),
+		)
+	default:
+		qmsg = fmt.Sprintf(
+			"POST to %v%v/scan with an %v header to (re)scan.",
+			URLPATH,
+			APIPATH,
+			APICSRFHEADER,
+		)
+	}
+	st := totalStats()
+	sum := []struct {
+		k string
+		v interface{}
+	}{
+		{"Queue length", s.QueueLength},
+		{"Service uptime", time.Since(START)},
+		{"Completed scans", st.Scans},
+		{"Average scan time", st.Average},
+		{"Median scan time", st.Median},
+	}
+	if FORMATMARKDOWN == f {
+		fmt.Fprintf(
+			w,
+			"# %v for %v\n\n%v\n\n",
+			mdEscape(SITE.Title),
 			ip,
-			URLPATH, URLPATH,
 			qmsg,
-			qlen,
-			time.Now().Sub(START),
-			NSCAN,
-			AVGTIME,
-			res,
-		),
-	)
-	debug("%v Reported status: %v", ip, qmsg)
+		)
+		for _, kv := range sum {
+			fmt.Fprintf(w, "* %v: %v\n", kv.k, kv.v)
+		}
+		fmt.Fprintf(w, "\n")
+		if nil == s.Latest {
+			fmt.Fprintf(w, "%v\n", noRes)
+		} else {
+			writeResultMarkdown(w, "##", s.Latest, s.Annotation)
+		}
+	} else {
+		fmt.Fprintf(w, "%v for %v\n\n%v\n\n", SITE.Title, ip, qmsg)
+		for _, kv := range sum {
+			fmt.Fprintf(w, "%17v: %v\n", kv.k, kv.v)
+		}
+		fmt.Fprintf(w, "\nMost recent scan results:\n\n")
+		if nil == s.Latest {
+			fmt.Fprintf(w, "%v\n", noRes)
+		} else {
+			w.Write(s.Latest.Report())
+		}
+	}
+	debug("%v Reported %v status: %v", ip, f, s.State)
 }
 
 /* inQueue checks a's position in the queue, and returns whetehr it's being
@@ -0,0 +1,114 @@
+package main
+
+/*
+ * store.go
+ * Result storage
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/* Store stores scan results.  Every implementation must be safe for
+concurrent use. */
+type Store interface {
+	/* Save stores r as the latest result for its address and adds it to
+	the address' history.  If r has no ID, one will be assigned. */
+	Save(r *result) error
+
+	/* Get returns the latest result for address a, or nil if there is
+	none */
+	Get(a string) (*result, error)
+
+	/* List calls f on the latest result for every address, in address
+	order, until f returns an error.  f must not use the Store. */
+	List(f func(r *result) error) error
+
+	/* Delete removes all of the results for address a */
+	Delete(a string) error
+
+	/* History returns all of the results for address a, oldest first */
+	History(a string) ([]*result, error)
+
+	/* PutKV stores v under key k in the named bucket, which holds
+	miscellaneous data other than results.  Buckets are created as
+	needed. */
+	PutKV(bucket, k string, v []byte) error
+
+	/* GetKV gets the value stored under key k in the named bucket, or
+	nil if there is none */
+	GetKV(bucket, k string) ([]byte, error)
+
+	/* DeleteKV removes key k from the named bucket */
+	DeleteKV(bucket, k string) error
+
+	/* ForEachKV calls f on every key and value in the named bucket, in
+	key order, until f returns an error.  f must not use the Store. */
+	ForEachKV(bucket string, f func(k string, v []byte) error) error
+
+	/* ForEachKVFrom is like ForEachKV, but starts at key from, or the
+	first key after it, or if desc is true goes backwards from from, or
+	the first key before it.  If from is the empty string, it starts at
+	the first key, or the last if desc is true.  f must not use the
+	Store. */
+	ForEachKVFrom(
+		bucket, from string,
+		desc bool,
+		f func(k string, v []byte) error,
+	) error
+
+	/* Close releases any resources held by the Store */
+	Close() error
+}
+
+/* ERRSTOPWALK may be returned by the function passed to ForEachKVFrom to stop
+early.  It's not returned by ForEachKVFrom. */
+var ERRSTOPWALK = errors.New("stop walking")
+
+/* STORES are the names of the available Stores */
+var STORES = []string{"bolt", "memory", "sqlite"}
+
+/* openStore opens a Store of the given kind, one of STORES.  Bolt and sqlite
+Stores keep their data in the file at path, and if timeout is nonzero give up
+after waiting that long for another process to release the file. */
+func openStore(kind, path string, timeout time.Duration) (Store, error) {
+	switch kind {
+	case "bolt":
+		return openBoltStore(path, timeout)
+	case "memory":
+		return newMemStore(), nil
+	case "sqlite":
+		return openSQLStore(path, timeout)
+	default:
+		return nil, fmt.Errorf(
+			"unknown store %q, must be one of %q",
+			kind,
+			STORES,
+		)
+	}
+}
+
+/* newScanID makes a scan ID from the time t.  IDs sort in time order. */
+func newScanID(t time.Time) string {
+	return fmt.Sprintf("%016x", t.UnixNano())
+}
+
+/* setID gives r an ID if it hasn't got one, based on its start time, or its
+end time for results without a start time */
+func (r *result) setID() {
+	if "" != r.ID {
+		return
+	}
+	if !r.Start.IsZero() {
+		r.ID = newScanID(r.Start)
+	} else if !r.End.IsZero() {
+		r.ID = newScanID(r.End)
+	} else {
+		r.ID = newScanID(time.Unix(0, 0))
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+/*
+ * store_test.go
+ * Make sure every Store works the same
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/* testStores opens one of each kind of Store, in a temporary directory */
+func testStores(t *testing.T) map[string]Store {
+	ss := make(map[string]Store)
+	for _, kind := range []string{"memory", "bolt", "sqlite"} {
+		s, err := openStore(
+			kind,
+			filepath.Join(t.TempDir(), "cgiscan.db"),
+			time.Second,
+		)
+		if nil != err {
+			t.Fatalf("Opening %v store: %v", kind, err)
+		}
+		t.Cleanup(func() { s.Close() })
+		ss[kind] = s
+	}
+	return ss
+}
+
+/* testResult makes a result for a, finished at the given hour */
+func testResult(a string, hour int, ports ...int) *result {
+	end := time.Date(2026, 10, 18, hour, 0, 0, 0, time.UTC)
+	r := &result{
+		Addr:  a,
+		Start: end.Add(-time.Minute),
+		End:   end,
+	}
+	for _, p := range ports {
+		r.Ports = append(r.Ports, portRes{
+			Port:    p,
+			Service: "svc",
+			Banner:  []byte("banner"),
+		})
+	}
+	return r
+}
+
+/* sameResult makes sure got is want, as it'd come back from a Store */
+func sameResult(t *testing.T, what string, got, want *result) {
+	t.Helper()
+	if nil == got {
+		t.Fatalf("%v: got no result, want %v", what, want.Addr)
+	}
+	if got.ID != want.ID || got.Addr != want.Addr ||
+		!got.Start.Equal(want.Start) || !got.End.Equal(want.End) ||
+		!reflect.DeepEqual(got.Ports, want.Ports) {
+		t.Fatalf("%v: got %+v, want %+v", what, got, want)
+	}
+}
+
+func TestStoreResults(t *testing.T) {
+	for kind, s := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			/* Nothing there yet */
+			if r, err := s.Get("10.0.0.1"); nil != err || nil != r {
+				t.Fatalf("Get before Save: %v, %v", r, err)
+			}
+
+			/* Save a few */
+			old := testResult("10.0.0.1", 1, 22)
+			cur := testResult("10.0.0.1", 2, 22, 80)
+			other := testResult("10.0.0.2", 3)
+			for _, r := range []*result{old, cur, other} {
+				if err := s.Save(r); nil != err {
+					t.Fatalf("Save %v: %v", r.Addr, err)
+				}
+				if "" == r.ID {
+					t.Fatalf("Save %v: no ID", r.Addr)
+				}
+			}
+
+			/* The latest should come back */
+			r, err := s.Get("10.0.0.1")
+			if nil != err {
+				t.Fatalf("Get: %v", err)
+			}
+			sameResult(t, "Get", r, cur)
+
+			/* As should all of them */
+			h, err := s.History("10.0.0.1")
+			if nil != err {
+				t.Fatalf("History: %v", err)
+			}
+			if 2 != len(h) {
+				t.Fatalf("History: got %v, want 2", len(h))
+			}
+			sameResult(t, "History[0]", h[0], old)
+			sameResult(t, "History[1]", h[1], cur)
+
+			/* Listing gets the latest for each address */
+			var as []string
+			if err := s.List(func(r *result) error {
+				as = append(as, r.Addr)
+				return nil
+			}); nil != err {
+				t.Fatalf("List: %v", err)
+			}
+			if want := []string{
+				"10.0.0.1",
+				"10.0.0.2",
+			}; !reflect.DeepEqual(as, want) {
+				t.Fatalf("List: got %q, want %q", as, want)
+			}
+
+			/* Deleting removes the lot */
+			if err := s.Delete("10.0.0.1"); nil != err {
+				t.Fatalf("Delete: %v", err)
+			}
+			if r, err := s.Get("10.0.0.1"); nil != err || nil != r {
+				t.Fatalf("Get after Delete: %v, %v", r, err)
+			}
+			if h, err := s.History("10.0.0.1"); nil != err ||
+				0 != len(h) {
+				t.Fatalf("History after Delete: %v, %v", h, err)
+			}
+			if r, err := s.Get("10.0.0.2"); nil != err {
+				t.Fatalf("Get other after Delete: %v", err)
+			} else {
+				sameResult(t, "Get other", r, other)
+			}
+		})
+	}
+}
+
+func TestStoreKV(t *testing.T) {
+	for kind, s := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			const b = "Test"
+
+			/* Nothing there yet */
+			if v, err := s.GetKV(b, "a"); nil != err || nil != v {
+				t.Fatalf("GetKV before PutKV: %q, %v", v, err)
+			}
+			if err := s.ForEachKV(
+				b,
+				func(k string, v []byte) error {
+					t.Fatalf("ForEachKV on empty got %q", k)
+					return nil
+				},
+			); nil != err {
+				t.Fatalf("ForEachKV on empty bucket: %v", err)
+			}
+
+			/* Put, replace, and get */
+			for _, k := range []string{"d", "b", "a", "c", "e"} {
+				v := []byte("x" + k)
+				if err := s.PutKV(b, k, v); nil != err {
+					t.Fatalf("PutKV %q: %v", k, err)
+				}
+			}
+			if err := s.PutKV(b, "a", []byte("A")); nil != err {
+				t.Fatalf("PutKV replacing: %v", err)
+			}
+			if v, err := s.GetKV(b, "a"); nil != err ||
+				!bytes.Equal([]byte("A"), v) {
+				t.Fatalf("GetKV: got %q, %v, want A", v, err)
+			}
+
+			/* Delete */
+			if err := s.DeleteKV(b, "e"); nil != err {
+				t.Fatalf("DeleteKV: %v", err)
+			}
+			if v, err := s.GetKV(b, "e"); nil != err || nil != v {
+				t.Fatalf("GetKV after DeleteKV: %q, %v", v, err)
+			}
+
+			/* Every key, in order */
+			var ks []string
+			if err := s.ForEachKV(
+				b,
+				func(k string, v []byte) error {
+					ks = append(ks, k+"="+string(v))
+					return nil
+				},
+			); nil != err {
+				t.Fatalf("ForEachKV: %v", err)
+			}
+			if want := []string{
+				"a=A",
+				"b=xb",
+				"c=xc",
+				"d=xd",
+			}; !reflect.DeepEqual(ks, want) {
+				t.Fatalf("ForEachKV: got %q, want %q", ks, want)
+			}
+		})
+	}
+}
+
+func TestStoreForEachKVFrom(t *testing.T) {
+	for kind, s := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			const b = "Test"
+			for _, k := range []string{"b", "d", "f"} {
+				if err := s.PutKV(b, k, []byte(k)); nil != err {
+					t.Fatalf("PutKV %q: %v", k, err)
+				}
+			}
+			for _, c := range []struct {
+				from string
+				desc bool
+				max  int /* Keys before stopping, 0 for all */
+				want []string
+			}{
+				{"", false, 0, []string{"b", "d", "f"}},
+				{"", true, 0, []string{"f", "d", "b"}},
+				{"d", false, 0, []string{"d", "f"}},
+				{"c", false, 0, []string{"d", "f"}},
+				{"c", true, 0, []string{"b"}},
+				{"d", true, 0, []string{"d", "b"}},
+				{"a", true, 0, nil},
+				{"g", false, 0, nil},
+				{"g", true, 0, []string{"f", "d", "b"}},
+				{"", false, 2, []string{"b", "d"}},
+			} {
+				var got []string
+				if err := s.ForEachKVFrom(
+					b,
+					c.from,
+					c.desc,
+					func(k string, v []byte) error {
+						if 0 != c.max &&
+							c.max == len(got) {
+							return ERRSTOPWALK
+						}
+						got = append(got, k)
+						return nil
+					},
+				); nil != err {
+					t.Fatalf(
+						"ForEachKVFrom(%q, %v): %v",
+						c.from,
+						c.desc,
+						err,
+					)
+				}
+				if !reflect.DeepEqual(got, c.want) {
+					t.Errorf(
+						"ForEachKVFrom(%q, %v): "+
+							"got %q, want %q",
+						c.from,
+						c.desc,
+						got,
+						c.want,
+					)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+/*
+ * template.go
+ * HTML templates
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* LAYOUTTEMPLATE holds the templates common to every page */
+const LAYOUTTEMPLATE = "layout.html"
+
+/* DEFTEMPLATES are the default templates, one per page plus the layout */
+//go:embed templates/*.html
+var DEFTEMPLATES embed.FS
+
+/* TEMPLATES holds the parsed template for each page, by file name */
+var TEMPLATES = make(map[string]*template.Template)
+
+/* TEMPLATEFUNCS are available to every template */
+var TEMPLATEFUNCS = template.FuncMap{
+	"urlpath":    func() string { return URLPATH },
+	"apipath":    func() string { return APIPATH },
+	"pubkeypath": func() string { return PUBKEYPATH },
+	"rfc3339": func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	},
+	"ms": func(d time.Duration) time.Duration {
+		return d.Round(time.Millisecond)
+	},
+	"pad":        pad,
+	"lines":      func(s string) []string { return strings.Split(s, "\n") },
+	"site":       func() siteConfig { return SITE },
+	"stylesheet": stylesheetURL,
+	"contacturl": contactURL,
+	"paragraphs": paragraphs,
+}
+
+/* pad returns enough spaces to pad s to n characters */
+func pad(s string, n int) string {
+	if len(s) >= n {
+		return ""
+	}
+	return strings.Repeat(" ", n-len(s))
+}
+
+/* loadTemplates parses the page templates.  Templates in the directory dir,
+if it's not empty, are used in preference to the defaults with the same
+name. */
+func loadTemplates(dir string) error {
+	/* read gets a template from dir or the defaults */
+	read := func(name string) ([]byte, error) {
+		if "" != dir {
+			b, err := os.ReadFile(filepath.Join(dir, name))
+			if nil == err {
+				debug("Using template %v from %v", name, dir)
+				return b, nil
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		return DEFTEMPLATES.ReadFile("templates/" + name)
+	}
+
+	/* Every page gets the layout */
+	layout, err := read(LAYOUTTEMPLATE)
+	if nil != err {
+		return err
+	}
+
+	/* Parse each page */
+	names, err := fs.Glob(DEFTEMPLATES, "templates/*.html")
+	if nil != err {
+		return err
+	}
+	for _, name := range names {
+		name = filepath.Base(name)
+		if LAYOUTTEMPLATE == name {
+			continue
+		}
+		b, err := read(name)
+		if nil != err {
+			return err
+		}
+		t := template.New(name).Funcs(TEMPLATEFUNCS)
+		if _, err := t.New(LAYOUTTEMPLATE).Parse(string(layout)); nil != err {
+			return err
+		}
+		if _, err := t.Parse(string(b)); nil != err {
+			return err
+		}
+		TEMPLATES[name] = t
+	}
+	return nil
+}
+
+/* renderPage renders the page template name with data and sends it to w.  The
+page is rendered before anything's sent, so a broken template gets an HTTP 500
+and not half a page.  Errors are logged as well as returned. */
+func renderPage(w http.ResponseWriter, name string, data interface{}) error {
+	t, ok := TEMPLATES[name]
+	if !ok {
+		err := fmt.Errorf("no template %v", name)
+		log.Printf("Unable to render page: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "Unable to render page.")
+		return err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); nil != err {
+		log.Printf("Unable to render %v: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "Unable to render page.")
+		return err
+	}
+	if "" == w.Header().Get("Content-Type") {
+		w.Header().Set("Content-Type", FORMATTYPES[FORMATHTML])
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
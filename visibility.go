@@ -0,0 +1,225 @@
+package main
+
+/*
+ * visibility.go
+ * Who may see which results
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+/* Who may see an address' results, settable with -visibility */
+const (
+	VISPUBLIC    = "public"    /* Anybody */
+	VISREQUESTOR = "requestor" /* Only the address itself */
+	VISADMIN     = "admin"     /* Only administrators */
+)
+
+/* How addresses are shown in lists, settable with -listaddrs */
+const (
+	ADDRSFULL      = "full"      /* As-is */
+	ADDRSTRUNCATED = "truncated" /* Only the network */
+	ADDRSHASHED    = "hashed"    /* A keyed hash */
+)
+
+/* Networks to which addresses are truncated, and the narrowest networks which
+may be listed if addresses aren't shown in full */
+const (
+	TRUNCBITS4 = 24
+	TRUNCBITS6 = 48
+)
+
+/* PRIVACYBUCKET holds the key used to hash addresses */
+const PRIVACYBUCKET = "Privacy"
+
+/* ADDRHASHLEN is the number of bytes of an address' hash which are used */
+const ADDRHASHLEN = 8
+
+/* Current visibility settings */
+var (
+	VISIBILITY = VISPUBLIC
+	LISTADDRS  = ADDRSFULL
+)
+
+/* ADDRHASHKEY keys the hashes of addresses, so they can't be reversed by
+hashing every address */
+var ADDRHASHKEY []byte
+
+/* setVisibility checks and sets VISIBILITY and LISTADDRS */
+func setVisibility(vis, addrs string) error {
+	switch vis {
+	case VISPUBLIC, VISREQUESTOR, VISADMIN:
+	default:
+		return fmt.Errorf(
+			"visibility must be %q, %q, or %q",
+			VISPUBLIC,
+			VISREQUESTOR,
+			VISADMIN,
+		)
+	}
+	switch addrs {
+	case ADDRSFULL, ADDRSTRUNCATED, ADDRSHASHED:
+	default:
+		return fmt.Errorf(
+			"listed addresses must be %q, %q, or %q",
+			ADDRSFULL,
+			ADDRSTRUNCATED,
+			ADDRSHASHED,
+		)
+	}
+	VISIBILITY, LISTADDRS = vis, addrs
+	return nil
+}
+
+/* loadAddrHashKey gets the key used to hash addresses from the database,
+making one if there isn't one yet.  Keeping it in the database keeps hashes
+the same across restarts. */
+func loadAddrHashKey() error {
+	k, err := STORE.GetKV(PRIVACYBUCKET, "hashkey")
+	if nil != err {
+		return err
+	}
+	if nil == k {
+		k = make([]byte, sha256.Size)
+		if _, err := rand.Read(k); nil != err {
+			return err
+		}
+		if err := STORE.PutKV(PRIVACYBUCKET, "hashkey", k); nil != err {
+			return err
+		}
+	}
+	ADDRHASHKEY = k
+	return nil
+}
+
+/* canSee returns true if the requestor at rip may see a's results */
+func canSee(rip, a string) bool {
+	switch VISIBILITY {
+	case VISPUBLIC:
+		return true
+	case VISREQUESTOR:
+		return sameAddr(rip, a)
+	default:
+		return false
+	}
+}
+
+/* reqCanSee is like canSee, but for the maker of req, at rip.  Administrators
+may see everything. */
+func reqCanSee(req *http.Request, rip, a string) bool {
+	return isAdmin(req) || canSee(rip, a)
+}
+
+/* sameAddr returns true if a and b are the same IP address, however
+they're written */
+func sameAddr(a, b string) bool {
+	ia, ib := net.ParseIP(a), net.ParseIP(b)
+	return nil != ia && ia.Equal(ib)
+}
+
+/* hiddenMessage says why a's results can't be seen */
+func hiddenMessage(a string) string {
+	if VISADMIN == VISIBILITY {
+		return "Scan results are only available to administrators."
+	}
+	return fmt.Sprintf("Results for %v are only available to %v.", a, a)
+}
+
+/* hiddenAddrs returns true if listed addresses aren't shown in full */
+func hiddenAddrs() bool { return ADDRSFULL != LISTADDRS }
+
+/* listable returns true if a may be listed to the requestor at rip.  Any
+address may be listed, without its results, if listed addresses are hidden; if
+not, only those whose results the requestor may see. */
+func listable(rip, a string) bool { return hiddenAddrs() || canSee(rip, a) }
+
+/* canSeeAnnotation returns true if the requestor at rip may see, or filter
+by, a's annotation.  Owners and labels could give away hidden addresses. */
+func canSeeAnnotation(rip, a string) bool {
+	return canSee(rip, a) && (!hiddenAddrs() || sameAddr(rip, a))
+}
+
+/* shownAddr returns a as it should be listed to the requestor at rip, and
+whether it should link to a's results.  Requestors always see their own
+address. */
+func shownAddr(rip, a string) (string, bool) {
+	if !hiddenAddrs() || sameAddr(rip, a) {
+		return a, canSee(rip, a)
+	}
+	if ADDRSTRUNCATED == LISTADDRS {
+		if n := truncatedNet(a); nil != n {
+			return n.String(), false
+		}
+	}
+	return "#" + hex.EncodeToString(addrHash(a)), false
+}
+
+/* truncatedNet returns the network to which a is truncated, or nil if a isn't
+an IP address */
+func truncatedNet(a string) *net.IPNet {
+	ip := net.ParseIP(a)
+	if nil == ip {
+		return nil
+	}
+	if ip4 := ip.To4(); nil != ip4 {
+		m := net.CIDRMask(TRUNCBITS4, 32)
+		return &net.IPNet{IP: ip4.Mask(m), Mask: m}
+	}
+	m := net.CIDRMask(TRUNCBITS6, 128)
+	return &net.IPNet{IP: ip.Mask(m), Mask: m}
+}
+
+/* addrHash returns the first ADDRHASHLEN bytes of a's keyed hash */
+func addrHash(a string) []byte {
+	m := hmac.New(sha256.New, ADDRHASHKEY)
+	m.Write(addrKey(a))
+	return m.Sum(nil)[:ADDRHASHLEN]
+}
+
+/* listKey returns a key by which a may be sorted in lists.  If listed
+addresses are hidden, it doesn't give away the address, but truncated
+addresses still sort by network. */
+func listKey(a string) []byte {
+	switch LISTADDRS {
+	case ADDRSTRUNCATED:
+		n := truncatedNet(a)
+		if nil == n {
+			return nil
+		}
+		return append(addrKey(n.IP.String()), addrHash(a)...)
+	case ADDRSHASHED:
+		if nil == addrKey(a) {
+			return nil
+		}
+		return addrHash(a)
+	default:
+		return addrKey(a)
+	}
+}
+
+/* checkListNet makes sure n isn't so narrow it'd give away hidden
+addresses.  n may be nil. */
+func checkListNet(n *net.IPNet) error {
+	if !hiddenAddrs() || nil == n {
+		return nil
+	}
+	ones, bits := n.Mask.Size()
+	max := TRUNCBITS6
+	if 32 == bits {
+		max = TRUNCBITS4
+	}
+	if ones > max {
+		return fmt.Errorf("networks may be no smaller than /%v", max)
+	}
+	return nil
+}